@@ -1,7 +1,18 @@
 package gof
 
+import (
+	"fmt"
+	"net/http"
+)
+
 type ConnStatus int
 
+// 连接空闲时保留的读缓冲区上限，超过之后释放掉，避免一条大消息之后一直占用内存
+const maxIdleInBufSize = 64 * 1024
+
+// 每个连接发送队列的默认上限，客户端一直不读取时不会无限占用内存
+const defaultMaxWriteQueueSize = 64 << 20
+
 const (
 	CONN_NEW     ConnStatus = 1 //新连接
 	CONN_CLOSE   ConnStatus = 2 //关闭连接
@@ -28,17 +39,36 @@ const (
 
 // The message types are defined in RFC 6455, section 11.8.
 const (
-	TextMessage   = 1  //文本消息
-	BinaryMessage = 2  //二进制消息
-	CloseMessage  = 8  //关闭消息
-	PingMessage   = 9  //ping消息
-	PongMessage   = 10 //pong消息
+	ContinuationMessage = 0  //延续帧，分片消息除第一帧外的其余帧
+	TextMessage         = 1  //文本消息
+	BinaryMessage       = 2  //二进制消息
+	CloseMessage        = 8  //关闭消息
+	PingMessage         = 9  //ping消息
+	PongMessage         = 10 //pong消息
+)
+
+// CloseError 连接因为协议错误、消息过大等原因被服务端关闭时，通过 ErrorInterface 上报的错误
+type CloseError struct {
+	Code uint16 //发送给对端的关闭状态码
+	Text string //关闭原因
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: close %d %s", e.Code, e.Text)
+}
+
+// 发送单条消息时的压缩方式，只有协商了 permessage-deflate 的连接才会压缩
+const (
+	CompressAuto  = 0 //按照 IsCompressOn 和 CompressThreshold 决定是否压缩
+	CompressForce = 1 //不管消息长度都压缩，适合可压缩性很高的内容，比如JSON
+	CompressSkip  = 2 //不压缩，适合已经压缩过的内容，比如图片
 )
 
 type Message struct {
 	Conn        *Conn
 	MessageType int
 	Content     []byte
+	Compress    int //发送时的压缩方式，默认为 CompressAuto
 }
 
 type WriteMessage struct {
@@ -47,9 +77,21 @@ type WriteMessage struct {
 }
 
 type Conf struct {
-	ReadBufferSize    int
-	WriteBufferSize   int
-	ConnectionTimeOut int64
-	CompressLevel     int
-	IsCompressOn      bool
+	ReadBufferSize            int
+	WriteBufferSize           int
+	ConnectionTimeOut         int64
+	CompressLevel             int
+	IsCompressOn              bool
+	CompressNoContextTakeover bool                          //为true时压缩不在消息之间保留上下文，压缩率变低，但每个连接不用一直占用压缩器的内存
+	CompressThreshold         int                           //小于这个长度（字节）的消息不压缩直接发送，为0时都压缩
+	PingInterval              int64                         //服务端发送ping的间隔（秒），为0时不发送
+	MaxMissedPongs            int                           //连续多少次没有收到pong就关闭连接，默认为3
+	CloseTimeOut              int64                         //主动关闭连接时等待对端回复关闭帧的时间（秒），默认为5
+	MaxMessageSize            int64                         //单条消息的最大长度（字节），超过时以1009关闭连接，为0时不限制
+	MaxFrameSize              int64                         //单个帧的最大长度（字节），超过时以1009关闭连接，为0时不限制
+	HandshakeTimeOut          int64                         //从接受连接到收到完整握手请求的超时时间（秒），超时的连接直接关闭，默认为10
+	MaxHeaderSize             int                           //握手请求行和请求头的最大长度（字节），超过时回复431，默认为8K
+	Subprotocols              []string                      //服务端支持的子协议，按优先级排列
+	CheckOrigin               func(header http.Header) bool //校验握手请求的 Origin，为nil时只允许没有 Origin 或者和 Host 同源的请求
+	MaxWriteQueueSize         int64                         //每个连接还没有写入fd的内容的上限（字节），积压超过上限时关闭连接，默认为64M
 }
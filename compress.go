@@ -4,20 +4,168 @@ import (
 	"bytes"
 	"compress/flate"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
 )
 
+// 压缩时去掉的消息结尾，加上一个空的最后块，解压时补在消息后面让解压器正常结束
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// flateWriterPools 按压缩等级缓存的压缩器，下标为 level-flate.HuffmanOnly
+var flateWriterPools [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
+
+// flateReaderPool 缓存的解压器，解压器和压缩等级无关
+var flateReaderPool = sync.Pool{New: func() interface{} {
+	return flate.NewReader(nil)
+}}
+
+// @Description //从对应压缩等级的池中取出一个压缩器，输出写到w中
+// @Param w 压缩内容的输出 level 压缩等级
+// @return
+func getFlateWriter(w io.Writer, level int) (*flate.Writer, error) {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return nil, fmt.Errorf("websocket: invalid compression level %d", level)
+	}
+	if fw, ok := flateWriterPools[level-flate.HuffmanOnly].Get().(*flate.Writer); ok {
+		fw.Reset(w)
+		return fw, nil
+	}
+	return flate.NewWriter(w, level)
+}
+
+// putFlateWriter 把压缩器放回对应压缩等级的池中
+func putFlateWriter(fw *flate.Writer, level int) {
+	flateWriterPools[level-flate.HuffmanOnly].Put(fw)
+}
+
+// getFlateReader 从池中取出一个解压器，从r中读取压缩内容，dict为之前消息的内容
+func getFlateReader(r io.Reader, dict []byte) io.ReadCloser {
+	fr := flateReaderPool.Get().(io.ReadCloser)
+	_ = fr.(flate.Resetter).Reset(r, dict)
+	return fr
+}
+
+// putFlateReader 把解压器放回池中
+func putFlateReader(fr io.ReadCloser) {
+	flateReaderPool.Put(fr)
+}
+
+var (
+	errInvalidCompressedData = &CloseError{Code: CloseInvalidFramePayloadData, Text: "invalid compressed data"}
+	errInflatedTooBig        = &CloseError{Code: CloseMessageTooBig, Text: "decompressed message too big"}
+)
+
+// inflateError 把解压器返回的错误转换为关闭连接时使用的错误，连接断开等其它错误原样返回
+func inflateError(err error) error {
+	switch err.(type) {
+	case flate.CorruptInputError, flate.InternalError:
+		return errInvalidCompressedData
+	}
+	if err == io.ErrUnexpectedEOF {
+		return errInvalidCompressedData
+	}
+	return err
+}
+
+// @Description //读取解压之后的全部内容，防止很小的压缩内容解压出超大的消息
+// @Param fr 解压器 limit 解压之后的最大长度，为0时不限制
+// @return 解压之后的内容
+func readInflated(fr io.Reader, limit int64) ([]byte, error) {
+	if limit > 0 {
+		fr = io.LimitReader(fr, limit+1)
+	}
+	out, err := ioutil.ReadAll(fr)
+	if err != nil {
+		return nil, inflateError(err)
+	}
+	if limit > 0 && int64(len(out)) > limit {
+		return nil, errInflatedTooBig
+	}
+	return out, nil
+}
+
+// flateReadCloser 流式解压一条消息，Close 时把解压器放回池中
+type flateReadCloser struct {
+	c         *Conn
+	fr        io.ReadCloser
+	limit     int64 //解压之后的最大长度，为0时不限制
+	remaining int64 //还可以读取的长度
+}
+
+// Read 解压出错或者超过长度限制时上报错误，并以1007或1009关闭连接
+func (r *flateReadCloser) Read(p []byte) (int, error) {
+	if r.fr == nil {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := r.fr.Read(p)
+	if r.limit > 0 {
+		r.remaining -= int64(n)
+		if r.remaining < 0 {
+			n += int(r.remaining)
+			return n, r.fail(errInflatedTooBig)
+		}
+	}
+	if err != nil && err != io.EOF {
+		select {
+		case <-r.c.closeDone: //连接已经断开，消息没有读完，不是压缩内容的问题
+			return n, err
+		default:
+		}
+		if ce, ok := inflateError(err).(*CloseError); ok {
+			return n, r.fail(ce)
+		}
+	}
+	return n, err
+}
+
+// fail 上报错误并关闭连接
+func (r *flateReadCloser) fail(err *CloseError) error {
+	Log.Error("解压 fd 为 %d 的连接发送的消息失败：%+v", r.c.fd, err.Error())
+	r.c.s.reportError(r.c, err)
+	_ = r.c.Close(err.Code, err.Text)
+	return err
+}
+
+func (r *flateReadCloser) Close() error {
+	if r.fr == nil {
+		return nil
+	}
+	err := r.fr.Close()
+	putFlateReader(r.fr)
+	r.fr = nil
+	return err
+}
+
+// deCompressReader 流式解压c收到的一条消息，解压之后的长度受 MaxMessageSize 限制，读取完之后需要 Close
+func deCompressReader(c *Conn, r io.Reader) io.ReadCloser {
+	return &flateReadCloser{
+		c:         c,
+		fr:        getFlateReader(io.MultiReader(r, bytes.NewReader(deflateTail)), nil),
+		limit:     c.s.maxMessageSize,
+		remaining: c.s.maxMessageSize,
+	}
+}
+
 // @Author WangKan
-// @Description //解压消息
+// @Description //解压消息，c不为nil时解压之后的长度受 MaxMessageSize 限制
 // @Date 2021/3/3 10:09
 // @Param
-// @return
+// @return 压缩内容不合法时返回1007对应的 *CloseError，超过长度限制时返回1009对应的 *CloseError
 func DeCompress(content []byte, c *Conn) ([]byte, error) {
-	content= append(content, 0x00,0x00,0xff,0xff,0x01,0x00,0x00,0xff,0xff)
-	fr := flate.NewReader(bytes.NewReader(content))
-	content, err := ioutil.ReadAll(fr)
-	fmt.Printf("frw:%+v,err:%+v\n", content, err)
-	return content, nil
+	var limit int64
+	if c != nil {
+		limit = c.s.maxMessageSize
+		if c.flate != nil && c.flate.clientTakeover {
+			return c.flate.decompress(content, limit)
+		}
+	}
+	content= append(content, deflateTail...)
+	fr := getFlateReader(bytes.NewReader(content), nil)
+	defer putFlateReader(fr)
+	return readInflated(fr, limit)
 }
 
 // @Author WangKan
@@ -27,12 +175,228 @@ func DeCompress(content []byte, c *Conn) ([]byte, error) {
 // @return
 func Compress(content []byte, compressLevel int) ([]byte, error) {
 	buf := bytes.NewBuffer(nil)
-	fw, err := flate.NewWriter(buf, compressLevel)
+	fw, err := getFlateWriter(buf, compressLevel)
 	if err != nil {
 		return nil, err
 	}
+	defer putFlateWriter(fw, compressLevel)
 	_, _ = fw.Write(content)
 	_ = fw.Flush()
-	_ = fw.Close()
-	return []byte(buf.String()), nil
+	return trimDeflateTail(buf.Bytes()), nil
+}
+
+// trimDeflateTail 去掉 Flush 在压缩内容末尾写入的 0x00 0x00 0xff 0xff，RFC 7692 7.2.1
+func trimDeflateTail(b []byte) []byte {
+	return b[:len(b)-4]
+}
+
+// compress/flate 的滑动窗口固定为32K，也就是 max_window_bits 为15
+const maxWindowBits = 15
+
+// compressionOptions 握手时协商的 permessage-deflate 参数，RFC 7692 第7节
+type compressionOptions struct {
+	serverNoContextTakeover bool //服务端压缩时不保留上下文
+	clientNoContextTakeover bool //客户端压缩时不保留上下文
+	serverMaxWindowBits     int  //服务端压缩的滑动窗口大小，为0时没有协商
+	clientMaxWindowBits     int  //客户端压缩的滑动窗口大小，为0时没有协商
+}
+
+// String 返回回复给客户端的 Sec-WebSocket-Extensions 内容
+func (o compressionOptions) String() string {
+	s := "permessage-deflate"
+	if o.serverNoContextTakeover {
+		s += "; server_no_context_takeover"
+	}
+	if o.clientNoContextTakeover {
+		s += "; client_no_context_takeover"
+	}
+	if o.serverMaxWindowBits > 0 {
+		s += "; server_max_window_bits=" + strconv.Itoa(o.serverMaxWindowBits)
+	}
+	if o.clientMaxWindowBits > 0 {
+		s += "; client_max_window_bits=" + strconv.Itoa(o.clientMaxWindowBits)
+	}
+	return s
+}
+
+// extensionOffer 客户端在 Sec-WebSocket-Extensions 中提出的一个扩展
+type extensionOffer struct {
+	name    string
+	params  map[string]string //参数名都转为小写，没有值的参数值为空字符串
+	invalid bool              //参数重复等格式错误
+}
+
+// @Description //解析 Sec-WebSocket-Extensions，多个扩展之间以逗号分隔，扩展的参数之间以分号分隔
+// @Param header Sec-WebSocket-Extensions 的内容
+// @return 客户端按优先级排列的扩展
+func parseExtensions(header string) []extensionOffer {
+	var offers []extensionOffer
+	for _, part := range strings.Split(header, ",") {
+		items := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(items[0]))
+		if name == "" {
+			continue
+		}
+		offer := extensionOffer{name: name, params: make(map[string]string)}
+		for _, item := range items[1:] {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			key, value := item, ""
+			if i := strings.IndexByte(item, '='); i >= 0 {
+				key = strings.TrimSpace(item[:i])
+				value = strings.Trim(strings.TrimSpace(item[i+1:]), `"`)
+			}
+			key = strings.ToLower(key)
+			if _, ok := offer.params[key]; ok {
+				offer.invalid = true
+			}
+			offer.params[key] = value
+		}
+		offers = append(offers, offer)
+	}
+	return offers
+}
+
+// @Description //协商 permessage-deflate，选择客户端提出的第一个可以接受的参数组合
+// @Param offers 客户端提出的扩展 base 服务端自己要求的参数，比如不保留上下文
+// @return 协商的参数，没有可以接受的组合时返回false
+func negotiateCompression(offers []extensionOffer, base compressionOptions) (compressionOptions, bool) {
+	for _, offer := range offers {
+		if offer.name != "permessage-deflate" || offer.invalid {
+			continue
+		}
+		opts := base
+		ok := true
+		for key, value := range offer.params {
+			switch key {
+			case "server_no_context_takeover":
+				opts.serverNoContextTakeover = true
+				ok = ok && value == ""
+			case "client_no_context_takeover":
+				opts.clientNoContextTakeover = true
+				ok = ok && value == ""
+			case "server_max_window_bits":
+				//服务端的滑动窗口没法缩小，客户端要求更小的窗口时拒绝这一组参数
+				bits, err := strconv.Atoi(value)
+				ok = ok && err == nil && bits == maxWindowBits
+				opts.serverMaxWindowBits = bits
+			case "client_max_window_bits":
+				//没有值时表示客户端支持限制窗口大小，解压器可以处理任意大小的窗口，不需要限制
+				if value == "" {
+					break
+				}
+				bits, err := strconv.Atoi(value)
+				ok = ok && err == nil && bits >= 8 && bits <= maxWindowBits
+				opts.clientMaxWindowBits = bits
+			default:
+				ok = false
+			}
+		}
+		if ok {
+			return opts, true
+		}
+	}
+	return compressionOptions{}, false
+}
+
+// flateContext 协商了上下文接管时，连接上保留的压缩器和解压器，滑动窗口在消息之间延续
+type flateContext struct {
+	mu             sync.Mutex
+	serverTakeover bool //服务端压缩时保留上下文
+	clientTakeover bool //客户端压缩时保留上下文，解压时需要用之前的内容作为字典
+	level          int
+	writer         *flate.Writer
+	buf            bytes.Buffer  //writer 的输出
+	reader         io.ReadCloser //解压器，每条消息用 flate.Resetter 重置
+	dict           []byte        //最近解压出的内容，最多保留一个滑动窗口
+	released       bool          //连接关闭之后释放了压缩状态
+}
+
+// newFlateContext 双方都不保留上下文时返回nil，每条消息使用新的压缩器和解压器
+func newFlateContext(opts compressionOptions, level int) *flateContext {
+	if opts.serverNoContextTakeover && opts.clientNoContextTakeover {
+		return nil
+	}
+	return &flateContext{
+		serverTakeover: !opts.serverNoContextTakeover,
+		clientTakeover: !opts.clientNoContextTakeover,
+		level:          level,
+	}
+}
+
+// @Description //使用连接上保留的压缩器压缩一条消息，同一个连接上的消息必须按发送的顺序压缩
+// @Param content 消息内容
+// @return 去掉末尾 0x00 0x00 0xff 0xff 之后的压缩内容
+func (f *flateContext) compress(content []byte) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.released {
+		return nil, ErrConnClosed
+	}
+	if f.writer == nil {
+		w, err := getFlateWriter(&f.buf, f.level)
+		if err != nil {
+			return nil, err
+		}
+		f.writer = w
+	}
+	f.buf.Reset()
+	if _, err := f.writer.Write(content); err != nil {
+		return nil, err
+	}
+	if err := f.writer.Flush(); err != nil {
+		return nil, err
+	}
+	//buf 会被下一条消息复用，需要复制一份
+	return append([]byte(nil), trimDeflateTail(f.buf.Bytes())...), nil
+}
+
+// @Description //使用之前解压出的内容作为字典解压一条消息，并把这条消息的内容加入字典
+// @Param content 去掉了末尾 0x00 0x00 0xff 0xff 的压缩内容 limit 解压之后的最大长度，为0时不限制
+// @return 解压之后的内容
+func (f *flateContext) decompress(content []byte, limit int64) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.released {
+		return nil, ErrConnClosed
+	}
+	src := io.MultiReader(bytes.NewReader(content), bytes.NewReader(deflateTail))
+	if f.reader == nil {
+		f.reader = getFlateReader(src, f.dict)
+	} else if err := f.reader.(flate.Resetter).Reset(src, f.dict); err != nil {
+		return nil, err
+	}
+	out, err := readInflated(f.reader, limit)
+	if err != nil {
+		return nil, err
+	}
+	//解压器会复制字典，这里可以直接复用 dict 的空间，只保留最后一个滑动窗口
+	const window = 1 << maxWindowBits
+	if len(out) >= window {
+		f.dict = append(f.dict[:0], out[len(out)-window:]...)
+	} else {
+		if n := len(f.dict) + len(out) - window; n > 0 {
+			f.dict = f.dict[:copy(f.dict, f.dict[n:])]
+		}
+		f.dict = append(f.dict, out...)
+	}
+	return out, nil
+}
+
+// release 连接关闭时把压缩器和解压器放回池中，并释放字典
+func (f *flateContext) release() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.released = true
+	if f.writer != nil {
+		putFlateWriter(f.writer, f.level)
+		f.writer = nil
+	}
+	if f.reader != nil {
+		putFlateReader(f.reader)
+		f.reader = nil
+	}
+	f.dict = nil
 }
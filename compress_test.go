@@ -0,0 +1,87 @@
+package gof
+
+import (
+	"reflect"
+	"testing"
+)
+
+// 多个扩展以逗号分隔，参数名不区分大小写，参数值可以带引号，重复的参数标记为不合法
+func TestParseExtensions(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []extensionOffer
+	}{
+		{"", nil},
+		{"permessage-deflate", []extensionOffer{
+			{name: "permessage-deflate", params: map[string]string{}},
+		}},
+		{"permessage-deflate; client_max_window_bits, permessage-deflate", []extensionOffer{
+			{name: "permessage-deflate", params: map[string]string{"client_max_window_bits": ""}},
+			{name: "permessage-deflate", params: map[string]string{}},
+		}},
+		{` Permessage-Deflate ; Server_Max_Window_Bits = "15" ;`, []extensionOffer{
+			{name: "permessage-deflate", params: map[string]string{"server_max_window_bits": "15"}},
+		}},
+		{"x-webkit-deflate-frame, , permessage-deflate; server_no_context_takeover; server_no_context_takeover", []extensionOffer{
+			{name: "x-webkit-deflate-frame", params: map[string]string{}},
+			{name: "permessage-deflate", params: map[string]string{"server_no_context_takeover": ""}, invalid: true},
+		}},
+	}
+	for _, tt := range tests {
+		if got := parseExtensions(tt.header); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseExtensions(%q) = %+v, want %+v", tt.header, got, tt.want)
+		}
+	}
+}
+
+// 选择客户端提出的第一组可以接受的参数，服务端要求的参数始终保留
+func TestNegotiateCompression(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		base   compressionOptions
+		want   compressionOptions
+		ok     bool
+	}{
+		{"no offer", "", compressionOptions{}, compressionOptions{}, false},
+		{"other extension", "x-webkit-deflate-frame", compressionOptions{}, compressionOptions{}, false},
+		{"plain", "permessage-deflate", compressionOptions{}, compressionOptions{}, true},
+		{"server requires no context takeover", "permessage-deflate",
+			compressionOptions{serverNoContextTakeover: true, clientNoContextTakeover: true},
+			compressionOptions{serverNoContextTakeover: true, clientNoContextTakeover: true}, true},
+		{"client asks no context takeover", "permessage-deflate; server_no_context_takeover; client_no_context_takeover",
+			compressionOptions{},
+			compressionOptions{serverNoContextTakeover: true, clientNoContextTakeover: true}, true},
+		{"client window without value", "permessage-deflate; client_max_window_bits",
+			compressionOptions{}, compressionOptions{}, true},
+		{"client window", "permessage-deflate; client_max_window_bits=10",
+			compressionOptions{}, compressionOptions{clientMaxWindowBits: 10}, true},
+		{"server window 15", "permessage-deflate; server_max_window_bits=15",
+			compressionOptions{}, compressionOptions{serverMaxWindowBits: 15}, true},
+		{"smaller server window falls back", "permessage-deflate; server_max_window_bits=10, permessage-deflate",
+			compressionOptions{}, compressionOptions{}, true},
+		{"client window out of range", "permessage-deflate; client_max_window_bits=7",
+			compressionOptions{}, compressionOptions{}, false},
+		{"value on flag parameter", "permessage-deflate; server_no_context_takeover=1",
+			compressionOptions{}, compressionOptions{}, false},
+		{"unknown parameter", "permessage-deflate; foo",
+			compressionOptions{}, compressionOptions{}, false},
+		{"duplicate parameter", "permessage-deflate; client_no_context_takeover; client_no_context_takeover",
+			compressionOptions{}, compressionOptions{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := negotiateCompression(parseExtensions(tt.header), tt.base)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("%s: got %+v, %v; want %+v, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// 回复给客户端的 Sec-WebSocket-Extensions 只包含协商了的参数
+func TestCompressionOptionsString(t *testing.T) {
+	opts := compressionOptions{serverNoContextTakeover: true, clientMaxWindowBits: 10}
+	want := "permessage-deflate; server_no_context_takeover; client_max_window_bits=10"
+	if got := opts.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
@@ -2,134 +2,380 @@ package gof
 
 import (
 	"encoding/binary"
-	"fmt"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode/utf8"
+)
+
+var (
+	// ErrCloseSent 已经发送过关闭帧，不能再发送其它的帧
+	ErrCloseSent = errors.New("websocket: close sent")
+	// ErrConnClosed 连接已经关闭
+	ErrConnClosed = errors.New("websocket: connection closed")
+	// ErrInvalidMessageType 只能发送文本消息和二进制消息
+	ErrInvalidMessageType = errors.New("websocket: invalid message type")
+	// ErrInvalidCompressMode 压缩方式只能是 CompressAuto、CompressForce 或者 CompressSkip
+	ErrInvalidCompressMode = errors.New("websocket: invalid compress mode")
 )
 
 type Conn struct {
 	s           *Server
-	fd          int          //当前连接的文件描述符 fd
-	updateTime  int64        //最新的更新时间，判断超时用
-	handShake   chan Message //用于前期的验证和握手请求
-	method      string       //请求方式 websocket必须是get请求方式
-	closeCode   uint16       //关闭状态码
-	closeReason []byte       //关闭原因
-	canCompress bool         //是否支持压缩
+	fd          int                //当前连接的文件描述符 fd
+	updateTime  int64              //最新的更新时间，判断超时用
+	handShake   chan Message       //用于前期的验证和握手请求
+	method      string             //请求方式 websocket必须是get请求方式
+	closeCode   uint16             //关闭状态码
+	closeReason []byte             //关闭原因
+	closeMu     sync.Mutex         //closeCode 和 closeReason 会在多个协程中读写
+	closeSent   bool               //是否已经发送了关闭帧，由 fdMu 保护
+	closed      bool               //fd是否已经关闭，由 fdMu 保护
+	closeOnce   sync.Once          //保证连接只会被释放一次
+	closeDone   chan struct{}      //连接被释放之后关闭
+	canCompress bool               //是否支持压缩
+	compression compressionOptions //握手时协商的 permessage-deflate 参数
+	subprotocol string             //握手时协商的子协议，没有协商时为空
+	handle      WebSocketInterface //处理这个连接的handle，按子协议分发时不是 Server.handle
+	request     *Request           //握手请求
+	flate       *flateContext      //协商了上下文接管时保留的压缩状态，连接关闭时释放
+	closing     bool               //是否已经加入了关闭队列
+	inBuf       []byte             //已经从fd中读取的内容，inOff 之后的部分还没有解析成帧
+	inOff       int                //inBuf 中已经解析过的内容的长度，积累多了之后才移走，避免大帧每次读取都整体拷贝
+	inNeed      int                //还没有读完的帧需要的总字节数，未解析的内容不足时不必再解析帧头
+	decoder     frameDecoder       //帧解析器
+	fdMu        sync.Mutex         //读写fd之前持有，检查fd是否已经关闭，避免读写被系统复用的fd；同时保证帧不会交错写入，保护发送队列
+	outBuf      []byte             //已经编码、还没有写入fd的内容，fd可写之后由epoll的协程继续写入
+	outSince    time.Time          //发送队列最后一次有进展的时间，超过 connectionTimeout 没有进展时关闭连接
+	outTimer    *time.Timer        //发送队列积压时检查写入是否超时
+	flushClose  bool               //发送队列写完之后关闭连接，保证关闭帧能发送出去
+	outCond     *sync.Cond         //发送队列变短或者连接关闭时通知等待的流式发送
+	msgMu       sync.Mutex         //保护下面的消息队列，分片消息的帧之间只能穿插控制帧
+	outMsgs     []*Message         //还没有编码的消息和控制帧，同一时间只会有一个push协程按顺序发送
+	pushing     bool               //是否已经有push协程在发送这个连接的消息队列
+	closeQueued bool               //关闭帧已经加入消息队列，之后不能再发送其它的消息
+	released    bool               //消息队列发送完之后释放连接，之后不能再加入新的消息
+	streaming   bool               //是否有 NextWriter 正在流式发送，期间新加入的数据消息等流式发送结束再发送
+	streamAhead int                //开始流式发送时排在前面、还没有发送完的数据消息的数量
+	pushingData bool               //push协程是否正在发送一条数据消息
+	msgCond     *sync.Cond         //streamAhead 变为0或者连接释放时通知等待的 NextWriter
+	streamSem   chan struct{}      //同一个连接同一时间只能有一个 NextWriter
+	missedPongs int32              //服务端发送ping之后连续没有收到pong的次数
+	stream      *messageReader     //正在流式读取的消息
+	readPaused  int32              //流式读取的业务方处理不过来时暂停读取fd，为1时表示已暂停
+	streamSize  int64              //正在流式读取的消息已经接收的长度
+	streamDone  chan struct{}      //上一条流式读取的消息的 OnMessageReader 返回之后关闭
+
+	fragmentType       int    //分片消息的类型，0表示当前没有未完成的分片消息
+	fragments          []byte //分片消息已接收到的内容
+	fragmentCompressed bool   //分片消息是否被压缩，由第一帧的RSV1决定
 }
 
 func newConn(fd int, server *Server) *Conn {
-	return &Conn{
+	c := &Conn{
 		s:          server,
 		fd:         fd,
+		handle:     server.handle,
 		handShake:  make(chan Message, 1024),
 		updateTime: time.Now().Unix(),
+		closeDone:  make(chan struct{}),
+		decoder:    frameDecoder{maxFrameSize: server.maxFrameSize},
+		streamSem:  make(chan struct{}, 1),
 	}
+	c.outCond = sync.NewCond(&c.fdMu)
+	c.msgCond = sync.NewCond(&c.msgMu)
+	return c
 }
 
 func (c *Conn) GetFd() int {
 	return c.fd
 }
 
+// Request 返回握手请求，可以在 OnConnect 中根据请求的路径、参数、请求头做鉴权和路由
+func (c *Conn) Request() *Request {
+	return c.request
+}
+
+// RemoteAddr 返回客户端的地址，IPv4或者IPv6，双栈监听时IPv4客户端也返回IPv4的格式
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.request == nil {
+		return nil
+	}
+	return c.request.remoteAddr
+}
+
+// Subprotocol 返回握手时协商的子协议，没有协商时返回空字符串
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
 func (c *Conn) Read() {
+	select {
+	case <-c.closeDone: //连接已经释放，fd可能已经被系统复用
+		return
+	default:
+	}
 	buf := c.s.readBufPool.Get().([]byte)
-	defer func() {
-		buf = make([]byte, c.s.readBufferSize)
-		c.s.readBufPool.Put(buf)
-	}()
-	nbytes, _ := syscall.Read(c.fd, buf)
-	if nbytes > 0 {
-		Log.Info("Conn Read received message header:%b", buf[:2])
-		//查询状态
-		msgtype := int((buf[0] << 4) >> 4)
-		//查询掩码
-		mask := buf[1] >> 7
-
-		if mask != 1 { //如果没有掩码，就直接将数据抛弃掉
+	defer c.s.readBufPool.Put(buf)
+	//epoll是边缘触发模式，必须一直读到EAGAIN为止，否则剩下的内容不会再收到通知。
+	//流式读取的业务方处理不过来时会暂停读取，等业务方读走内容之后再重新调用Read
+	for {
+		//一次读取中可能包含多个帧，也可能只有半个帧，解析出所有完整的帧，剩下的留到下次读取时处理
+		c.parseFrames()
+		if c.closing || atomic.LoadInt32(&c.readPaused) == 1 {
+			return
+		}
+		nbytes, err := c.readFd(buf)
+		if err == ErrConnClosed { //读取的过程中连接被释放了
 			return
 		}
-		//根据消息类型做处理
-		switch msgtype {
-		case CloseMessage:
-			//获取关闭信息
-			closeReason := c.s.bytePool.Get().([]byte)
-			closeReason = c.getMessage(buf[:])
-			c.closeCode = binary.BigEndian.Uint16(closeReason[:2])
-			c.closeReason = closeReason[2:]
-			closeReason = []byte{}
-			c.s.bytePool.Put(closeReason)
-			c.s.closeChan <- c
-
-		case BinaryMessage, TextMessage: //如果是二进制或者文本消息
-			msg := c.s.messagePool.Get().(*Message)
-			msg.MessageType = msgtype
-			msg.Content = c.getMessage(buf[:])
-			//发送内容
-			newTime := time.Now().Unix()
-			_ = c.s.checkTimeOutTree.Set(c.updateTime, newTime, c.fd)
-			c.updateTime = newTime
-			if c.canCompress == true && c.s.isComporessOn == true {
-				// 一个缓存区压缩的内容
-				var err error
-				fmt.Printf("msg.Content===%b\n", msg.Content)
-				msg.Content, err = DeCompress(msg.Content, c)
-				if err != nil {
-					Log.Fatal("解压句柄为 %d 的消息失败：%+v", c.fd, err.Error())
-					return
-				}
-			}
-			msg.Conn = c
-			c.s.readMessageChan <- msg
-			msg = &Message{
-				Content: make([]byte, 0, c.s.writeBufferSize),
-			}
-			c.s.messagePool.Put(msg)
+		if nbytes > 0 {
+			c.inBuf = append(c.inBuf, buf[:nbytes]...)
+			continue
+		}
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != syscall.EAGAIN { //对端已经关闭连接或者读取出错
+			c.setCloseStatus(CloseAbnormalClosure, nil)
+			c.shutdown()
 		}
 		return
 	}
 }
 
-// @Author WangKan
-// @Description //将接收到的消息解包
-// @Date 2021/2/2 18:14
-// @Param
-// @return
-func (c *Conn) getMessage(buf []byte) []byte {
-	//查询数据的长度
-	datalen := int64((buf[1] << 1) >> 1)
-	//掩码默认从第二字节开始
-	maskStart := 2
-	//如果data长度小于125，就直接取字节长度
-	if datalen == 126 { //如果data长度等于126，就往后增加两个字节长度
-		datalen = int64(binary.BigEndian.Uint16(buf[2:3]))
-		maskStart = 4
-	} else if datalen == 127 {
-		datalen = int64(binary.BigEndian.Uint64(buf[2:9]))
-		maskStart = 10
-	}
-	//4位的掩码
-	maskSlice := c.s.bytePool.Get().([]byte)
-
-	maskSlice = buf[maskStart : maskStart+4]
-	datastart := int64(maskStart + 4)
-	maskIndex := 0
-	content := c.s.bytePool.Get().([]byte)
-	for i := datastart; i < datalen+datastart; i++ {
-		content = append(content, buf[i]^maskSlice[maskIndex])
-		if maskIndex == 3 {
-			maskIndex = 0
-		} else {
-			maskIndex++
+// readFd 持有 fdMu 读取fd，连接已经释放时返回 ErrConnClosed，fd关闭之后可能已经被新的连接复用
+func (c *Conn) readFd(buf []byte) (int, error) {
+	c.fdMu.Lock()
+	defer c.fdMu.Unlock()
+	if c.closed {
+		return 0, ErrConnClosed
+	}
+	return syscall.Read(c.fd, buf)
+}
+
+// parseFrames 解析 inBuf 中所有完整的帧，剩下的内容留在 inBuf 中
+func (c *Conn) parseFrames() {
+	if len(c.inBuf)-c.inOff < c.inNeed { //当前的帧还没有全部到达
+		return
+	}
+	c.inNeed = 0
+	for !c.closing && atomic.LoadInt32(&c.readPaused) == 0 {
+		n, ok := c.parseFrame(c.inBuf[c.inOff:])
+		c.inOff += n
+		if !ok {
+			break
+		}
+	}
+	switch {
+	case c.inOff == len(c.inBuf): //全部解析完了，直接复用缓冲区
+		c.inBuf, c.inOff = c.inBuf[:0], 0
+		if cap(c.inBuf) > maxIdleInBufSize {
+			c.inBuf = nil
 		}
+	case c.inOff >= len(c.inBuf)-c.inOff: //已经解析的内容不少于剩下的内容时才移走，拷贝的总量和读取的总量成正比
+		c.inBuf = append(c.inBuf[:0], c.inBuf[c.inOff:]...)
+		c.inOff = 0
 	}
-	defer func() {
-		maskSlice = make([]byte, 0, c.s.writeBufferSize)
-		c.s.bytePool.Put(maskSlice)
-		content = make([]byte, 0, c.s.writeBufferSize)
-		c.s.bytePool.Put(content)
+}
 
-	}()
-	return content
+// @Description //从buf中解析一个帧并处理，流式读取时数据帧的负载有多少就处理多少，不必等待完整的帧
+// @Param buf 还没有解析的内容
+// @return 消耗的字节数，内容不足或者连接出错时返回false
+func (c *Conn) parseFrame(buf []byte) (int, bool) {
+	if c.decoder.inPayload {
+		return c.readStream(buf)
+	}
+	h, n, err := c.decoder.decodeHeader(buf)
+	if err != nil {
+		Log.Error("解析句柄为 %d 的消息失败：%+v", c.fd, err.Error())
+		c.failWithError(err)
+		return 0, false
+	}
+	if n == 0 {
+		return 0, false
+	}
+	isData := h.opcode == ContinuationMessage || h.opcode == TextMessage || h.opcode == BinaryMessage
+	if isData && !c.checkMessageSize(h) {
+		return 0, false
+	}
+	if _, ok := c.handle.(MessageReaderInterface); ok && isData {
+		c.beginStream(h)
+		return n, true
+	}
+	f, m := c.decoder.decodeFrame(h, buf[n:])
+	if f == nil {
+		c.inNeed = n + int(h.length) //负载还没有全部到达，记下需要的长度，之前不再解析帧头
+		return 0, false
+	}
+	c.handleFrame(f)
+	return n + m, true
+}
+
+// checkMessageSize 在分配内存之前检查消息的长度，超过 MaxMessageSize 时以1009关闭连接
+func (c *Conn) checkMessageSize(h frameHeader) bool {
+	if c.s.maxMessageSize <= 0 {
+		return true
+	}
+	size := h.length
+	if h.opcode == ContinuationMessage {
+		size += int64(len(c.fragments)) + c.streamSize
+	}
+	if size > c.s.maxMessageSize {
+		Log.Error("fd 为 %d 的连接发送的消息长度超过了 %d", c.fd, c.s.maxMessageSize)
+		c.fail(CloseMessageTooBig, "message too big")
+		return false
+	}
+	return true
+}
+
+// shutdown 停止读取连接，消息队列和发送队列都写完之后释放连接，同一个连接只会执行一次
+func (c *Conn) shutdown() {
+	if c.closing {
+		return
+	}
+	c.closing = true
+	c.msgMu.Lock()
+	c.released = true
+	c.unlockPush()
+}
+
+// fail 协议出错时向对端发送关闭帧，然后直接释放连接，不再等待对端的回复
+func (c *Conn) fail(code uint16, reason string) {
+	c.s.reportError(c, &CloseError{Code: code, Text: reason})
+	c.setCloseStatus(code, []byte(reason))
+	if err := c.queueControl(CloseMessage, closePayload(code, []byte(reason))); err != nil && err != ErrCloseSent {
+		Log.Error("send close to fd %d err: %+v", c.fd, err.Error())
+	}
+	c.shutdown()
+}
+
+// failWithError 根据出错的原因关闭连接，没有指定状态码的错误以1002关闭
+func (c *Conn) failWithError(err error) {
+	if ce, ok := err.(*CloseError); ok {
+		c.fail(ce.Code, ce.Text)
+		return
+	}
+	c.fail(CloseProtocolError, err.Error())
+}
+
+// setCloseStatus 记录连接关闭的状态码和原因，以第一次记录的为准
+func (c *Conn) setCloseStatus(code uint16, reason []byte) {
+	c.closeMu.Lock()
+	if c.closeCode == 0 {
+		c.closeCode, c.closeReason = code, reason
+	}
+	c.closeMu.Unlock()
+}
+
+// closeStatus 返回连接关闭的状态码和原因
+func (c *Conn) closeStatus() (uint16, []byte) {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	return c.closeCode, c.closeReason
+}
+
+// @Description //根据帧类型处理一个帧，数据帧会在收到FIN之后拼成完整的消息再交给业务方，控制帧可以穿插在分片之间
+// @Param f *frame
+func (c *Conn) handleFrame(f *frame) {
+	switch f.opcode {
+	case CloseMessage:
+		//获取关闭信息
+		code, reason, err := parseClosePayload(f.payload)
+		if err != nil {
+			Log.Error("fd 为 %d 的连接发送的关闭帧不合法：%+v", c.fd, err.Error())
+			c.failWithError(err)
+			return
+		}
+		c.setCloseStatus(code, reason)
+		//对端主动关闭时先回复关闭帧再释放连接；服务端主动关闭时这就是对端的回复，直接释放连接
+		if err := c.queueControl(CloseMessage, closePayload(code, reason)); err != nil && err != ErrCloseSent {
+			Log.Error("send close to fd %d err: %+v", c.fd, err.Error())
+		}
+		c.shutdown()
+
+	case PingMessage: //收到ping之后原样回复pong，由push协程发送，不在读取的协程中写fd
+		c.refreshUpdateTime()
+		if err := c.queueControl(PongMessage, f.payload); err != nil {
+			Log.Error("send pong to fd %d err: %+v", c.fd, err.Error())
+		}
+
+	case PongMessage:
+		atomic.StoreInt32(&c.missedPongs, 0)
+		c.refreshUpdateTime()
+
+	case ContinuationMessage:
+		if c.fragmentType == 0 { //没有未完成的分片消息，却收到了延续帧
+			Log.Error("fd 为 %d 的连接收到了无法对应的延续帧", c.fd)
+			c.fail(CloseProtocolError, "unexpected continuation frame")
+			return
+		}
+		c.fragments = append(c.fragments, f.payload...)
+		if f.fin {
+			msgtype, content, compressed := c.fragmentType, c.fragments, c.fragmentCompressed
+			c.fragmentType, c.fragments, c.fragmentCompressed = 0, nil, false
+			c.receiveMessage(msgtype, content, compressed)
+		}
+
+	case BinaryMessage, TextMessage: //如果是二进制或者文本消息
+		if c.fragmentType != 0 { //上一条分片消息还没有结束，不能开始新的消息
+			Log.Error("fd 为 %d 的连接在分片消息未结束时收到了新的数据帧", c.fd)
+			c.fail(CloseProtocolError, "expected continuation frame")
+			return
+		}
+		if !f.fin { //分片消息的第一帧，先缓存起来，等待后续的延续帧
+			c.fragmentType = f.opcode
+			c.fragments = append(c.fragments[:0], f.payload...)
+			c.fragmentCompressed = f.rsv1
+			return
+		}
+		c.receiveMessage(f.opcode, f.payload, f.rsv1)
+	}
+}
+
+// refreshUpdateTime 刷新连接的最后活跃时间，并更新它在超时检测树中的位置
+func (c *Conn) refreshUpdateTime() {
+	newTime := time.Now().Unix()
+	c.s.timeOutMu.Lock()
+	_ = c.s.checkTimeOutTree.Set(c.updateTime, newTime, c.fd)
+	c.updateTime = newTime
+	c.s.timeOutMu.Unlock()
+}
+
+// @Description //将一条完整的消息解压后交给业务方处理
+// @Param msgtype 消息类型 content 消息内容 compressed 消息是否被压缩
+func (c *Conn) receiveMessage(msgtype int, content []byte, compressed bool) {
+	msg := c.s.messagePool.Get().(*Message)
+	msg.MessageType = msgtype
+	msg.Content = content
+	//发送内容
+	c.refreshUpdateTime()
+	if compressed == true && c.canCompress == true && c.s.isComporessOn == true {
+		// 一个缓存区压缩的内容
+		var err error
+		msg.Content, err = DeCompress(msg.Content, c)
+		if err == ErrConnClosed { //连接已经关闭，压缩状态已经释放
+			return
+		}
+		if err != nil {
+			Log.Error("解压句柄为 %d 的消息失败：%+v", c.fd, err.Error())
+			c.failWithError(err)
+			return
+		}
+	}
+	if msgtype == TextMessage && !utf8.Valid(msg.Content) { //文本消息必须是合法的UTF-8
+		Log.Error("fd 为 %d 的连接发送的文本消息不是合法的UTF-8", c.fd)
+		c.failWithError(errInvalidUTF8)
+		return
+	}
+	msg.Conn = c
+	c.s.deliver(msg)
+	msg = &Message{
+		Content: make([]byte, 0, c.s.writeBufferSize),
+	}
+	c.s.messagePool.Put(msg)
 }
 
 // @Author WangKan
@@ -138,11 +384,315 @@ func (c *Conn) getMessage(buf []byte) []byte {
 // @Param
 // @return
 func (c *Conn) Write(message []byte) {
-	c.s.writeMessageChan <- &Message{
+	_ = c.WriteMessage(TextMessage, message)
+}
+
+// WriteBinary 发送二进制消息
+func (c *Conn) WriteBinary(message []byte) {
+	_ = c.WriteMessage(BinaryMessage, message)
+}
+
+// @Description //发送指定类型的消息，消息会加入发送队列，由 Server.Push 异步发送
+// @Param messageType TextMessage 或者 BinaryMessage data 消息内容
+// @return
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	return c.WriteMessageWithCompress(messageType, data, CompressAuto)
+}
+
+// @Description //发送指定类型的消息，并指定这条消息是否压缩
+// @Param messageType TextMessage 或者 BinaryMessage data 消息内容 compress CompressAuto、CompressForce 或者 CompressSkip
+// @return
+func (c *Conn) WriteMessageWithCompress(messageType int, data []byte, compress int) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return ErrInvalidMessageType
+	}
+	if compress != CompressAuto && compress != CompressForce && compress != CompressSkip {
+		return ErrInvalidCompressMode
+	}
+	select {
+	case <-c.closeDone:
+		return ErrConnClosed
+	default:
+	}
+	return c.queueMessage(&Message{
 		Conn:        c,
-		MessageType: TextMessage,
-		Content:     message,
+		MessageType: messageType,
+		Content:     data,
+		Compress:    compress,
+	})
+}
+
+// @Description //把消息或者控制帧加入这个连接的消息队列，由push协程按顺序编码和发送，不会阻塞调用方
+// @Param m 需要发送的消息
+// @return 关闭帧已经加入队列时返回 ErrCloseSent，连接正在释放时返回 ErrConnClosed
+func (c *Conn) queueMessage(m *Message) error {
+	c.msgMu.Lock()
+	if c.released {
+		c.msgMu.Unlock()
+		return ErrConnClosed
+	}
+	if c.closeQueued {
+		c.msgMu.Unlock()
+		return ErrCloseSent
+	}
+	if m.MessageType == CloseMessage {
+		c.closeQueued = true
+	}
+	c.outMsgs = append(c.outMsgs, m)
+	c.unlockPush()
+	return nil
+}
+
+// queueControl 把控制帧加入消息队列，控制帧由push协程发送
+func (c *Conn) queueControl(opcode int, payload []byte) error {
+	return c.queueMessage(&Message{
+		Conn:        c,
+		MessageType: opcode,
+		Content:     payload,
+	})
+}
+
+// unlockPush 释放 msgMu，还没有push协程在发送这个连接的消息时交给一个push协程。
+// 加入 pushChan 必须在释放 msgMu 之后，否则可能和等待 msgMu 的push协程互相等待
+func (c *Conn) unlockPush() {
+	start := !c.pushing
+	c.pushing = true
+	c.msgMu.Unlock()
+	if start {
+		select {
+		case c.s.pushChan <- c:
+		case <-c.s.done: //服务已经关闭，push协程已经退出
+		}
+	}
+}
+
+// nextMessage 取出消息队列中下一条可以发送的消息，没有时返回nil，并返回是否需要释放连接。
+// 流式发送期间新加入的数据消息留在队列中等流式发送结束，控制帧照常发送
+func (c *Conn) nextMessage() (*Message, bool) {
+	c.msgMu.Lock()
+	defer c.msgMu.Unlock()
+	for i, m := range c.outMsgs {
+		isData := m.MessageType == TextMessage || m.MessageType == BinaryMessage
+		if isData && c.streaming && c.streamAhead == 0 {
+			continue
+		}
+		if i == 0 {
+			c.outMsgs[0] = nil
+			c.outMsgs = c.outMsgs[1:]
+		} else {
+			c.outMsgs = append(c.outMsgs[:i], c.outMsgs[i+1:]...)
+		}
+		c.pushingData = isData
+		return m, false
+	}
+	if len(c.outMsgs) == 0 {
+		c.outMsgs = nil
+	}
+	c.pushing = false
+	return nil, c.released
+}
+
+// dataSent push协程发送完一条数据消息，开始流式发送之前的消息都发送完之后通知 NextWriter
+func (c *Conn) dataSent() {
+	c.msgMu.Lock()
+	c.pushingData = false
+	if c.streamAhead > 0 {
+		c.streamAhead--
+		if c.streamAhead == 0 {
+			c.msgCond.Broadcast()
+		}
+	}
+	c.msgMu.Unlock()
+}
+
+// @Description //发送一个编码好的帧，不会阻塞调用方：发送队列为空时直接写入fd，内核写缓冲区满时剩下的部分加入发送队列，
+// 等fd可写之后由epoll的协程继续写入。写入出错、发送队列超过上限时释放连接
+// @Param b 编码好的帧，返回之后调用方可以复用
+// @return
+func (c *Conn) send(b []byte) error {
+	c.fdMu.Lock()
+	if c.closed {
+		c.fdMu.Unlock()
+		return ErrConnClosed
+	}
+	if c.closeSent {
+		c.fdMu.Unlock()
+		return ErrCloseSent
+	}
+	err := c.enqueue(b)
+	c.fdMu.Unlock()
+	if err != nil {
+		c.abortWrite(err)
+	}
+	return err
+}
+
+// @Description //把帧加入发送队列，调用方需要持有 fdMu
+// @Param b 编码好的帧
+// @return 写入出错或者发送队列超过 MaxWriteQueueSize 时返回错误
+func (c *Conn) enqueue(b []byte) error {
+	if len(c.outBuf) > 0 { //前面还有没写完的内容，只能排在后面
+		if max := c.s.maxWriteQueueSize; max > 0 && int64(len(c.outBuf)+len(b)) > max {
+			return errQueueFull
+		}
+		c.outBuf = append(c.outBuf, b...)
+		return nil
+	}
+	n, err := writeNonblock(c.fd, b)
+	if err != nil {
+		return err
+	}
+	if n < len(b) {
+		c.outBuf = append(c.outBuf, b[n:]...)
+		c.outSince = time.Now()
+		if c.outTimer == nil {
+			c.outTimer = time.AfterFunc(time.Duration(c.s.connectionTimeout)*time.Second, c.checkWriteTimeout)
+		}
+	}
+	return nil
+}
+
+// flush fd可写时继续写入发送队列中的内容，在epoll的协程中调用，不会阻塞
+func (c *Conn) flush() {
+	c.fdMu.Lock()
+	if c.closed || len(c.outBuf) == 0 {
+		c.fdMu.Unlock()
+		return
+	}
+	n, err := writeNonblock(c.fd, c.outBuf)
+	if n > 0 {
+		c.outSince = time.Now()
+		c.outBuf = c.outBuf[n:]
+		if len(c.outBuf) == 0 {
+			c.outBuf = nil
+		}
+		c.outCond.Broadcast()
+	}
+	done := err == nil && len(c.outBuf) == 0 && c.flushClose
+	c.fdMu.Unlock()
+	if err != nil {
+		c.abortWrite(err)
+	} else if done {
+		go c.s.closeFd(c)
 	}
-	return
+}
+
+// waitQueue 等待发送队列短于limit，流式发送时用来限制发送队列的长度，会阻塞调用方
+func (c *Conn) waitQueue(limit int) error {
+	c.fdMu.Lock()
+	defer c.fdMu.Unlock()
+	for !c.closed && len(c.outBuf) > limit {
+		c.outCond.Wait()
+	}
+	if c.closed {
+		return ErrConnClosed
+	}
+	return nil
+}
+
+// checkWriteTimeout 发送队列超过 connectionTimeout 没有写入任何内容时释放连接，比如客户端一直不读取
+func (c *Conn) checkWriteTimeout() {
+	timeout := time.Duration(c.s.connectionTimeout) * time.Second
+	c.fdMu.Lock()
+	if c.closed || len(c.outBuf) == 0 {
+		c.outTimer = nil
+		c.fdMu.Unlock()
+		return
+	}
+	if wait := timeout - time.Since(c.outSince); wait > 0 { //期间有进展，重新计时
+		c.outTimer.Reset(wait)
+		c.fdMu.Unlock()
+		return
+	}
+	c.outTimer = nil
+	c.fdMu.Unlock()
+	c.abortWrite(errWriteTimeout)
+}
 
+// closeAfterFlush 发送队列为空时返回true，由调用方立即释放连接；否则等发送队列写完之后再释放
+func (c *Conn) closeAfterFlush() bool {
+	c.fdMu.Lock()
+	defer c.fdMu.Unlock()
+	if c.closed || len(c.outBuf) == 0 {
+		return true
+	}
+	c.flushClose = true
+	return false
+}
+
+// abortWrite 写入出错、写入超时或者发送队列超过上限时直接释放连接，不再发送关闭帧。
+// 调用方可能是epoll或者push的协程，在新的协程中释放，不等待 OnClose
+func (c *Conn) abortWrite(err error) {
+	Log.Error("write to fd %d err: %+v", c.fd, err.Error())
+	c.setCloseStatus(CloseAbnormalClosure, nil)
+	go c.s.closeFd(c)
+}
+
+// @Description //编码并发送一个控制帧，控制帧可以穿插在分片消息之间发送。
+// 关闭帧只会发送一次，发送之后不能再发送其它的帧
+// @Param opcode 控制帧类型 payload 控制帧的内容
+// @return
+func (c *Conn) writeControl(opcode int, payload []byte) error {
+	b := c.s.encoder.encode(make([]byte, 0, len(payload)+2), &frame{
+		fin:     true,
+		opcode:  opcode,
+		payload: payload,
+	})
+	if opcode != CloseMessage {
+		return c.send(b)
+	}
+	c.fdMu.Lock()
+	if c.closed {
+		c.fdMu.Unlock()
+		return ErrConnClosed
+	}
+	if c.closeSent {
+		c.fdMu.Unlock()
+		return ErrCloseSent
+	}
+	c.closeSent = true
+	err := c.enqueue(b)
+	c.fdMu.Unlock()
+	if err != nil {
+		c.abortWrite(err)
+	}
+	return err
+}
+
+// @Description //主动关闭连接：先向对端发送关闭帧，等对端回复关闭帧之后再释放连接，超时没有回复也会释放连接
+// @Param code 关闭状态码，见 common.go 中的 Close 开头的常量，1005、1006、1015 只能在本地使用，不能发送 reason 关闭原因，不能超过123个字节
+// @return
+func (c *Conn) Close(code uint16, reason string) error {
+	if !isValidReceivedCloseCode(code) { //对端收到这些状态码会认为是协议错误
+		return errors.New("websocket: invalid close code")
+	}
+	if len(reason) > maxPayloadLen7-2 {
+		return errors.New("websocket: close reason too long")
+	}
+	c.setCloseStatus(code, []byte(reason))
+	if err := c.queueControl(CloseMessage, closePayload(code, []byte(reason))); err != nil {
+		return err
+	}
+	go func() {
+		timer := time.NewTimer(time.Duration(c.s.closeTimeout) * time.Second)
+		defer timer.Stop()
+		select {
+		case <-c.closeDone:
+		case <-timer.C:
+			Log.Info("fd 为 %d 的连接等待关闭帧超时", c.fd)
+			c.s.closeLater(c)
+		}
+	}()
+	return nil
+}
+
+// closePayload 关闭帧的内容，1005 表示没有状态码，关闭帧不带内容
+func closePayload(code uint16, reason []byte) []byte {
+	if code == CloseNoStatusReceived {
+		return nil
+	}
+	payload := make([]byte, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, code)
+	copy(payload[2:], reason)
+	return payload
 }
@@ -1,37 +1,62 @@
 package gof
 
 import (
+	"encoding/binary"
+	"fmt"
 	"golang.org/x/sys/unix"
 	"net"
-	"os"
+	"strings"
 	"sync"
 	"syscall"
 )
 
 const (
 	EPOLLLISTENER = syscall.EPOLLIN | syscall.EPOLLPRI | syscall.EPOLLERR | syscall.EPOLLHUP | unix.EPOLLET
+	EPOLLCONN     = EPOLLLISTENER | syscall.EPOLLOUT //客户端的连接还需要在fd可写时继续写入发送队列
 )
 
 type EpollObj struct {
-	socket    int        //socket连接
-	epId      int        //epoll 创建的唯一描述符
-	ip        string     //socket监听的地址
-	port      int        //socket监听的端口
-	eventPool *sync.Pool //接收epoll消息
+	socket    int              //socket连接
+	epId      int              //epoll 创建的唯一描述符
+	ip        string           //socket监听的地址
+	port      int              //socket监听的端口
+	family    int              //地址族，IPv4地址使用 AF_INET，IPv6地址使用 AF_INET6
+	addr      syscall.Sockaddr //绑定的地址
+	wakeFd    int              //eventfd，Server.Close 时写入，唤醒阻塞在 epoll_wait 中的 Run
+	eventPool *sync.Pool       //接收epoll消息
 }
 
-//初始化epoll 包含创建socket,监听端口，以及创建epoll监听
-func InitEpoll(ip string, port int) *EpollObj {
+//初始化epoll 包含创建socket,监听端口，以及创建epoll监听，任何一步失败时关闭已经创建的fd并返回错误
+func InitEpoll(ip string, port int) (*EpollObj, error) {
 	ep := &EpollObj{
 		eventPool: &sync.Pool{New: func() interface{} { return make([]syscall.EpollEvent, 1024) }},
 	}
 	ep.ip = ip
 	ep.port = port
-	return ep.getScoket().listen().getGlobalFd()
+	if err := ep.resolveAddr(); err != nil {
+		return nil, err
+	}
+	if err := ep.getScoket(); err != nil {
+		return nil, err
+	}
+	if err := ep.listen(); err != nil {
+		_ = syscall.Close(ep.socket)
+		return nil, err
+	}
+	if err := ep.getGlobalFd(); err != nil {
+		_ = syscall.Close(ep.socket)
+		return nil, err
+	}
+	if err := ep.getWakeFd(); err != nil {
+		_ = syscall.Close(ep.epId)
+		_ = syscall.Close(ep.socket)
+		return nil, err
+	}
+	return ep, nil
 }
 
 //创建socket对象
-func (e *EpollObj) getScoket() *EpollObj {
+func (e *EpollObj) getScoket() error {
 	/*第一个参数 domain
 	syscall.AF_INET，表示服务器之间的网络通信
 	syscall.AF_UNIX表示同一台机器上的进程通信
@@ -49,79 +74,144 @@ func (e *EpollObj) getScoket() *EpollObj {
 	IPPROTO_ICMP 接收ICMP协议的数据
 	IPPROTO_RAW 只能用来发送IP数据包，不能接收数据。
 	*/
-	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, syscall.IPPROTO_TCP)
+	fd, err := syscall.Socket(e.family, syscall.SOCK_STREAM, syscall.IPPROTO_TCP)
 	if err != nil {
-		Log.Error("getScoket err:%v", err.Error())
-		os.Exit(1)
+		return fmt.Errorf("websocket: create socket: %w", err)
 	}
 	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
-		Log.Error("set ReuseAddr failed,err:%v", err.Error())
-		os.Exit(1)
+		_ = syscall.Close(fd)
+		return fmt.Errorf("websocket: set SO_REUSEADDR: %w", err)
+	}
+	if e.family == syscall.AF_INET6 {
+		//关闭 IPV6_V6ONLY，监听 :: 时同时接受IPv4的连接（双栈），IPv4客户端的地址是 ::ffff:a.b.c.d
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 0); err != nil {
+			_ = syscall.Close(fd)
+			return fmt.Errorf("websocket: set IPV6_V6ONLY: %w", err)
+		}
 	}
 
 	e.socket = fd
-	return e
+	return nil
 }
 
 //监听端口
-func (e *EpollObj) listen() *EpollObj {
+func (e *EpollObj) listen() error {
 	if err := syscall.SetNonblock(e.socket, true); err != nil {
-		Log.Error("setnonblock err:%v", err.Error())
-		os.Exit(1)
+		return fmt.Errorf("websocket: set listener nonblock: %w", err)
 	}
 	//监听
-	addr := syscall.SockaddrInet4{Port: e.port}
-	ip := "0.0.0.0"
-	if e.ip != "" {
-		ip = e.ip
-	}
-	copy(addr.Addr[:], net.ParseIP(ip).To4())
-	if err := syscall.Bind(e.socket, &addr); err != nil {
-		Log.Error("bind err:%v", err.Error())
-		os.Exit(1)
+	if err := syscall.Bind(e.socket, e.addr); err != nil {
+		return fmt.Errorf("websocket: bind %s: %w", e.hostPort(), err)
 	}
 	if err := syscall.Listen(e.socket, 10); err != nil {
-		Log.Error("listen err:%v", err.Error())
-		os.Exit(1)
+		return fmt.Errorf("websocket: listen %s: %w", e.hostPort(), err)
 	}
-	return e
+	return nil
+}
+
+// @Description //根据监听的地址选择地址族，为空时监听 0.0.0.0；IPv6地址可以带方括号和 %网卡 的zone，比如 [fe80::1%eth0]
+// @return 地址不合法或者zone对应的网卡不存在时返回错误
+func (e *EpollObj) resolveAddr() error {
+	host := e.ip
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	zone := ""
+	if i := strings.LastIndexByte(host, '%'); i >= 0 {
+		host, zone = host[:i], host[i+1:]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("websocket: invalid listen address %q", e.ip)
+	}
+	if ip4 := ip.To4(); ip4 != nil && zone == "" {
+		sa := &syscall.SockaddrInet4{Port: e.port}
+		copy(sa.Addr[:], ip4)
+		e.family, e.addr = syscall.AF_INET, sa
+		return nil
+	}
+	sa := &syscall.SockaddrInet6{Port: e.port}
+	copy(sa.Addr[:], ip.To16())
+	if zone != "" {
+		ifi, err := net.InterfaceByName(zone)
+		if err != nil {
+			return fmt.Errorf("websocket: invalid listen address %q: %w", e.ip, err)
+		}
+		sa.ZoneId = uint32(ifi.Index)
+	}
+	e.family, e.addr = syscall.AF_INET6, sa
+	return nil
+}
+
+// hostPort 监听的地址，用于错误信息
+func (e *EpollObj) hostPort() string {
+	return sockaddrToAddr(e.addr).String()
 }
 
 //创建epollfd对象，并加入监听
-func (e *EpollObj) getGlobalFd() *EpollObj {
+func (e *EpollObj) getGlobalFd() error {
 	//创建epfd
 	epfd, err := syscall.EpollCreate1(0)
-	Log.Info("getGlobalFd 创建的epfd为：%+v,e.fd:%d", epfd, e.socket)
 	if err != nil {
-		Log.Error("epoll_create1 err:%+v", err)
-		os.Exit(1)
+		return fmt.Errorf("websocket: epoll_create1: %w", err)
 	}
+	Log.Info("getGlobalFd 创建的epfd为：%+v,e.fd:%d", epfd, e.socket)
 	e.epId = epfd
-	e.eAdd(e.socket)
-	return e
+	if err := e.eAdd(e.socket, EPOLLLISTENER); err != nil {
+		_ = syscall.Close(epfd)
+		return err
+	}
+	return nil
 }
 
-//EpollADD方法，添加、删除监听的fd
-//fd 需要监听的fd对象
+// getWakeFd 创建用来唤醒 epoll_wait 的eventfd，并加入epoll
+func (e *EpollObj) getWakeFd() error {
+	fd, err := unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("websocket: eventfd: %w", err)
+	}
+	if err := e.eAdd(fd, syscall.EPOLLIN); err != nil {
+		_ = syscall.Close(fd)
+		return err
+	}
+	e.wakeFd = fd
+	return nil
+}
+
+// wake 唤醒阻塞在 epoll_wait 中的协程，之后 eWait 返回 ErrServerClosed
+func (e *EpollObj) wake() error {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], 1)
+	if _, err := syscall.Write(e.wakeFd, b[:]); err != nil && err != syscall.EAGAIN {
+		return fmt.Errorf("websocket: wake epoll: %w", err)
+	}
+	return nil
+}
+
+//EpollADD方法，添加、删除监听的fd，失败时返回错误，由调用方决定只关闭这一个连接
+//fd 需要监听的fd对象 events 监听的事件
 //status syscall.EPOLL_CTL_ADD添加
-func (e *EpollObj) eAdd(fd int) {
+func (e *EpollObj) eAdd(fd int, events uint32) error {
 	//通过EpollCtl将epfd加入到Epoll中，去监听
-	if err := syscall.EpollCtl(e.epId, syscall.EPOLL_CTL_ADD, fd, &syscall.EpollEvent{Events: EPOLLLISTENER, Fd: int32(fd)}); err != nil {
-		Log.Error("epoll_ctl add err:%+v,fd:%+v", err, fd)
-		os.Exit(1)
+	if err := syscall.EpollCtl(e.epId, syscall.EPOLL_CTL_ADD, fd, &syscall.EpollEvent{Events: events, Fd: int32(fd)}); err != nil {
+		return fmt.Errorf("websocket: epoll_ctl add fd %d: %w", fd, err)
 	}
+	return nil
 }
 
 // syscall.EPOLL_CTL_DEL删除
-func (e *EpollObj) eDel(fd int) {
+func (e *EpollObj) eDel(fd int) error {
 	//通过EpollCtl将epfd加入到Epoll中，去监听
 	if err := syscall.EpollCtl(e.epId, syscall.EPOLL_CTL_DEL, fd, &syscall.EpollEvent{Events: EPOLLLISTENER, Fd: int32(fd)}); err != nil {
-		Log.Error("epoll_ctl del err:%+v,fd:%+v", err, fd)
-		os.Exit(1)
+		return fmt.Errorf("websocket: epoll_ctl del fd %d: %w", fd, err)
 	}
+	return nil
 }
 
-func (e *EpollObj) eWait(handle func(fd int, connType ConnStatus)) error {
+func (e *EpollObj) eWait(handle func(fd int, connType ConnStatus, events uint32)) error {
 	events := e.eventPool.Get().([]syscall.EpollEvent)
 	defer func() {
 		events := make([]syscall.EpollEvent, 1024)
@@ -129,16 +219,23 @@ func (e *EpollObj) eWait(handle func(fd int, connType ConnStatus)) error {
 	}()
 	n, err := syscall.EpollWait(e.epId, events[:], -1)
 	if err != nil {
-		Log.Error("epoll_wait err:%+v", err)
 		return err
 	}
+	woken := false
 	for i := 0; i < n; i++ {
+		if int(events[i].Fd) == e.wakeFd { //服务已经关闭，处理完这一批事件之后返回
+			woken = true
+			continue
+		}
 		//如果是系统描述符，就建立一个新的连接
 		connType := CONN_MESSAGE //默认是读内容
 		if int(events[i].Fd) == e.socket {
 			connType = CONN_NEW
 		}
-		handle(int(events[i].Fd), connType)
+		handle(int(events[i].Fd), connType, events[i].Events)
+	}
+	if woken {
+		return ErrServerClosed
 	}
 	return nil
 }
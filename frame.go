@@ -0,0 +1,320 @@
+package gof
+
+import (
+	"encoding/binary"
+	"unicode/utf8"
+)
+
+// 帧头中各个标志位，RFC 6455 5.2
+const (
+	finalBit = 1 << 7 //第一个字节：FIN
+	rsv1Bit  = 1 << 6 //第一个字节：RSV1，permessage-deflate 用来标识压缩
+	rsv2Bit  = 1 << 5 //第一个字节：RSV2
+	rsv3Bit  = 1 << 4 //第一个字节：RSV3
+	maskBit  = 1 << 7 //第二个字节：MASK
+)
+
+// 负载长度的三种编码方式
+const (
+	maxPayloadLen7  = 125   //长度小于等于125时直接写在第二个字节的后7位
+	payloadLen16    = 126   //第二个字节的后7位为126时，后面两个字节是负载长度
+	payloadLen64    = 127   //第二个字节的后7位为127时，后面八个字节是负载长度
+	maxPayloadLen16 = 65535 //两个字节能表示的最大长度
+)
+
+var (
+	errInvalidPayloadLength = &CloseError{Code: CloseProtocolError, Text: "invalid payload length"}
+	errFrameTooBig          = &CloseError{Code: CloseMessageTooBig, Text: "frame too big"}
+	errFrameNotMasked       = &CloseError{Code: CloseProtocolError, Text: "frame is not masked"}
+	errReservedBits         = &CloseError{Code: CloseProtocolError, Text: "unexpected reserved bits"}
+	errReservedOpcode       = &CloseError{Code: CloseProtocolError, Text: "unknown opcode"}
+	errControlTooLong       = &CloseError{Code: CloseProtocolError, Text: "control frame length > 125"}
+	errControlFragmented    = &CloseError{Code: CloseProtocolError, Text: "control frame not final"}
+	errInvalidClosePayload  = &CloseError{Code: CloseProtocolError, Text: "invalid close payload"}
+	errInvalidCloseCode     = &CloseError{Code: CloseProtocolError, Text: "invalid close code"}
+	errInvalidUTF8          = &CloseError{Code: CloseInvalidFramePayloadData, Text: "invalid utf8 payload"}
+)
+
+// frame 一个解析完成的websocket帧
+type frame struct {
+	fin     bool   //是否是消息的最后一帧
+	rsv1    bool   //RSV1位，permessage-deflate 用来标识消息被压缩
+	rsv2    bool   //RSV2位，没有协商扩展时必须为0
+	rsv3    bool   //RSV3位，没有协商扩展时必须为0
+	opcode  int    //帧类型
+	masked  bool   //是否带有掩码，客户端发送的帧必须带掩码
+	payload []byte //去掉掩码之后的内容
+}
+
+// frameHeader 帧头信息
+type frameHeader struct {
+	fin     bool
+	rsv1    bool
+	rsv2    bool
+	rsv3    bool
+	opcode  int
+	masked  bool
+	maskKey [4]byte
+	length  int64 //负载长度
+}
+
+// frameDecoder 从客户端发送过来的字节流中解析帧。
+// 流式读取时帧头解析之后负载可以分多次读取，当前帧的状态保存在decoder中
+type frameDecoder struct {
+	maxFrameSize int64 //单个帧负载的最大长度，为0时不限制
+	allowRSV1    bool  //是否协商了 permessage-deflate，协商之后数据消息的第一帧才能设置RSV1
+
+	header    frameHeader //正在读取负载的帧的帧头
+	inPayload bool        //帧头已经解析，正在读取负载
+	remaining int64       //当前帧还没有读取的负载长度
+	maskPos   int         //下一个负载字节对应的掩码位置
+}
+
+// @Description //解析帧头
+// @Param buf 还没有解析的内容
+// @return 帧头，帧头占用的字节数；内容不足以解析出帧头时返回的字节数为0
+func (d *frameDecoder) decodeHeader(buf []byte) (frameHeader, int, error) {
+	var h frameHeader
+	if len(buf) < 2 {
+		return h, 0, nil
+	}
+	h.fin = buf[0]&finalBit != 0
+	h.rsv1 = buf[0]&rsv1Bit != 0
+	h.rsv2 = buf[0]&rsv2Bit != 0
+	h.rsv3 = buf[0]&rsv3Bit != 0
+	h.opcode = int(buf[0] & 0x0f)
+	h.masked = buf[1]&maskBit != 0
+
+	//按照 RFC 6455 5.2 和 5.5 校验帧头
+	switch h.opcode {
+	case ContinuationMessage, TextMessage, BinaryMessage:
+		if h.rsv1 && (!d.allowRSV1 || h.opcode == ContinuationMessage) {
+			return h, 0, errReservedBits
+		}
+	case CloseMessage, PingMessage, PongMessage:
+		if h.rsv1 {
+			return h, 0, errReservedBits
+		}
+		if !h.fin {
+			return h, 0, errControlFragmented
+		}
+		if buf[1]&0x7f > maxPayloadLen7 {
+			return h, 0, errControlTooLong
+		}
+	default:
+		return h, 0, errReservedOpcode
+	}
+	if h.rsv2 || h.rsv3 {
+		return h, 0, errReservedBits
+	}
+	if !h.masked { //客户端发送的帧必须带掩码
+		return h, 0, errFrameNotMasked
+	}
+
+	n := 2
+	switch length := buf[1] & 0x7f; length {
+	case payloadLen16:
+		if len(buf) < n+2 {
+			return h, 0, nil
+		}
+		h.length = int64(binary.BigEndian.Uint16(buf[n : n+2]))
+		n += 2
+	case payloadLen64:
+		if len(buf) < n+8 {
+			return h, 0, nil
+		}
+		//64位长度的最高位必须为0
+		h.length = int64(binary.BigEndian.Uint64(buf[n : n+8]))
+		if h.length < 0 {
+			return h, 0, errInvalidPayloadLength
+		}
+		n += 8
+	default:
+		h.length = int64(length)
+	}
+	//在分配内存之前检查帧的长度
+	if d.maxFrameSize > 0 && h.length > d.maxFrameSize {
+		return h, 0, errFrameTooBig
+	}
+
+	if h.masked {
+		if len(buf) < n+4 {
+			return h, 0, nil
+		}
+		copy(h.maskKey[:], buf[n:n+4])
+		n += 4
+	}
+	return h, n, nil
+}
+
+// @Description //帧头解析完成之后，从buf中读取完整的负载
+// @Param h 已经解析的帧头 buf 帧头之后还没有解析的内容
+// @return 解析出的帧，负载占用的字节数；内容不足一帧时返回 nil, 0
+func (d *frameDecoder) decodeFrame(h frameHeader, buf []byte) (*frame, int) {
+	if int64(len(buf)) < h.length {
+		return nil, 0
+	}
+	f := &frame{
+		fin:     h.fin,
+		rsv1:    h.rsv1,
+		rsv2:    h.rsv2,
+		rsv3:    h.rsv3,
+		opcode:  h.opcode,
+		masked:  h.masked,
+		payload: make([]byte, h.length),
+	}
+	copy(f.payload, buf)
+	if h.masked {
+		maskBytes(h.maskKey, 0, f.payload)
+	}
+	return f, int(h.length)
+}
+
+// begin 开始分多次读取h对应帧的负载
+func (d *frameDecoder) begin(h frameHeader) {
+	d.header = h
+	d.inPayload = true
+	d.remaining = h.length
+	d.maskPos = 0
+}
+
+// @Description //读取当前帧的负载，buf中有多少就读取多少
+// @Param buf 还没有解析的内容
+// @return 去掉掩码之后的负载，消耗的字节数，当前帧的负载是否已经全部读取
+func (d *frameDecoder) readPayload(buf []byte) ([]byte, int, bool) {
+	n := int64(len(buf))
+	if n > d.remaining {
+		n = d.remaining
+	}
+	payload := make([]byte, n)
+	copy(payload, buf)
+	if d.header.masked {
+		d.maskPos = maskBytes(d.header.maskKey, d.maskPos, payload)
+	}
+	d.remaining -= n
+	if d.remaining == 0 {
+		d.inPayload = false
+	}
+	return payload, int(n), !d.inPayload
+}
+
+// maskBytes 对b做掩码运算，pos为b的第一个字节在整个负载中的位置，返回下一个字节的位置
+func maskBytes(key [4]byte, pos int, b []byte) int {
+	for i := range b {
+		b[i] ^= key[pos&3]
+		pos++
+	}
+	return pos & 3
+}
+
+// @Description //解析并校验对端发送的关闭帧的内容
+// @Param payload 关闭帧的负载
+// @return 关闭状态码，关闭原因；没有状态码时返回 CloseNoStatusReceived
+func parseClosePayload(payload []byte) (uint16, []byte, error) {
+	if len(payload) == 0 {
+		return CloseNoStatusReceived, nil, nil
+	}
+	if len(payload) == 1 {
+		return 0, nil, errInvalidClosePayload
+	}
+	code := binary.BigEndian.Uint16(payload[:2])
+	if !isValidReceivedCloseCode(code) {
+		return 0, nil, errInvalidCloseCode
+	}
+	reason := payload[2:]
+	if !utf8.Valid(reason) {
+		return 0, nil, errInvalidUTF8
+	}
+	return code, reason, nil
+}
+
+// isValidReceivedCloseCode 对端发送的关闭状态码是否合法，1005、1006、1015 只能在本地使用，不能出现在关闭帧中
+func isValidReceivedCloseCode(code uint16) bool {
+	switch code {
+	case CloseNormalClosure, CloseGoingAway, CloseProtocolError, CloseUnsupportedData,
+		CloseInvalidFramePayloadData, ClosePolicyViolation, CloseMessageTooBig,
+		CloseMandatoryExtension, CloseInternalServerErr, CloseServiceRestart, CloseTryAgainLater:
+		return true
+	}
+	//3000-3999 由 IANA 注册，4000-4999 由应用自己使用
+	return code >= 3000 && code <= 4999
+}
+
+// utf8Validator 分段校验UTF-8，一个字符可能被拆在相邻的两段中
+type utf8Validator struct {
+	tail []byte //上一段末尾不完整的字符
+}
+
+// write 校验一段内容，返回目前为止的内容是否合法
+func (v *utf8Validator) write(b []byte) bool {
+	if len(v.tail) > 0 {
+		//先补齐上一段末尾不完整的字符
+		need := utf8.UTFMax - len(v.tail)
+		if need > len(b) {
+			need = len(b)
+		}
+		buf := append(v.tail, b[:need]...)
+		if !utf8.FullRune(buf) {
+			v.tail = buf
+			return true
+		}
+		r, size := utf8.DecodeRune(buf)
+		if r == utf8.RuneError && size == 1 {
+			return false
+		}
+		b = b[size-len(v.tail):]
+		v.tail = v.tail[:0]
+	}
+	//末尾可能有不完整的字符，留到下一段再校验
+	i := len(b) - 1
+	for i >= 0 && i > len(b)-utf8.UTFMax && !utf8.RuneStart(b[i]) {
+		i--
+	}
+	if i >= 0 && !utf8.FullRune(b[i:]) {
+		v.tail = append(v.tail[:0], b[i:]...)
+		b = b[:i]
+	}
+	return utf8.Valid(b)
+}
+
+// done 所有内容都已经写入之后，不能再有不完整的字符
+func (v *utf8Validator) done() bool {
+	return len(v.tail) == 0
+}
+
+// frameEncoder 将消息编码为服务端发送的帧，服务端发送的帧不带掩码
+type frameEncoder struct{}
+
+// @Description //将帧编码后追加到dst中
+// @Param dst 目标缓冲区 f 需要编码的帧
+// @return 追加了帧之后的缓冲区
+func (e *frameEncoder) encode(dst []byte, f *frame) []byte {
+	dst = e.encodeHeader(dst, f, int64(len(f.payload)))
+	return append(dst, f.payload...)
+}
+
+// @Description //将帧头编码后追加到dst中，负载由调用方追加
+// @Param dst 目标缓冲区 f 需要编码的帧 length 负载的长度
+// @return 追加了帧头之后的缓冲区
+func (e *frameEncoder) encodeHeader(dst []byte, f *frame, length int64) []byte {
+	b0 := byte(f.opcode)
+	if f.fin {
+		b0 |= finalBit
+	}
+	if f.rsv1 {
+		b0 |= rsv1Bit
+	}
+	dst = append(dst, b0)
+
+	switch {
+	case length <= maxPayloadLen7:
+		dst = append(dst, byte(length))
+	case length <= maxPayloadLen16:
+		dst = append(dst, payloadLen16, 0, 0)
+		binary.BigEndian.PutUint16(dst[len(dst)-2:], uint16(length))
+	default:
+		dst = append(dst, payloadLen64, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(dst[len(dst)-8:], uint64(length))
+	}
+	return dst
+}
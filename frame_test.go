@@ -0,0 +1,176 @@
+package gof
+
+import (
+	"bytes"
+	"testing"
+)
+
+// maskFrame 把服务端编码的帧改成客户端发送的格式：设置MASK位，在帧头后面插入掩码，并对负载做掩码运算
+func maskFrame(b []byte, key [4]byte) []byte {
+	n := 2
+	switch b[1] & 0x7f {
+	case payloadLen16:
+		n += 2
+	case payloadLen64:
+		n += 8
+	}
+	out := make([]byte, 0, len(b)+4)
+	out = append(out, b[:n]...)
+	out[1] |= maskBit
+	out = append(out, key[:]...)
+	payload := append([]byte(nil), b[n:]...)
+	maskBytes(key, 0, payload)
+	return append(out, payload...)
+}
+
+// 负载长度在三种编码方式的边界上时，编码之后能解析出相同的帧
+func TestFrameRoundTrip(t *testing.T) {
+	key := [4]byte{0x12, 0x34, 0x56, 0x78}
+	tests := []struct {
+		length    int
+		headerLen int //帧头长度，包含4个字节的掩码
+	}{
+		{0, 6},
+		{maxPayloadLen7, 6},
+		{maxPayloadLen7 + 1, 8},
+		{maxPayloadLen16, 8},
+		{maxPayloadLen16 + 1, 14},
+	}
+	var e frameEncoder
+	for _, tt := range tests {
+		payload := make([]byte, tt.length)
+		for i := range payload {
+			payload[i] = byte(i)
+		}
+		buf := maskFrame(e.encode(nil, &frame{fin: true, opcode: BinaryMessage, payload: payload}), key)
+
+		var d frameDecoder
+		h, n, err := d.decodeHeader(buf)
+		if err != nil {
+			t.Fatalf("length %d: decodeHeader err: %v", tt.length, err)
+		}
+		if n != tt.headerLen {
+			t.Errorf("length %d: header length = %d, want %d", tt.length, n, tt.headerLen)
+		}
+		if h.length != int64(tt.length) || !h.fin || h.opcode != BinaryMessage || h.maskKey != key {
+			t.Errorf("length %d: got header %+v", tt.length, h)
+		}
+		f, m := d.decodeFrame(h, buf[n:])
+		if f == nil || m != tt.length {
+			t.Fatalf("length %d: decodeFrame consumed %d", tt.length, m)
+		}
+		if !bytes.Equal(f.payload, payload) {
+			t.Errorf("length %d: payload mismatch", tt.length)
+		}
+	}
+}
+
+// 负载长度超过32位时使用8个字节的长度，不实际分配负载，只校验帧头
+func TestFrameHeaderLength64(t *testing.T) {
+	const length = int64(1) << 32
+	var e frameEncoder
+	got := e.encodeHeader(nil, &frame{fin: true, opcode: BinaryMessage}, length)
+	want := []byte{finalBit | BinaryMessage, payloadLen64, 0, 0, 0, 1, 0, 0, 0, 0}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("encodeHeader = %x, want %x", got, want)
+	}
+
+	var d frameDecoder
+	h, n, err := d.decodeHeader(maskFrame(got, [4]byte{1, 2, 3, 4}))
+	if err != nil {
+		t.Fatalf("decodeHeader err: %v", err)
+	}
+	if n != 14 || h.length != length {
+		t.Errorf("decodeHeader = length %d, n %d; want %d, 14", h.length, n, length)
+	}
+
+	//超过 maxFrameSize 的帧在读取负载之前就被拒绝
+	d.maxFrameSize = length - 1
+	if _, _, err := d.decodeHeader(maskFrame(got, [4]byte{1, 2, 3, 4})); err != errFrameTooBig {
+		t.Errorf("decodeHeader with maxFrameSize err = %v, want %v", err, errFrameTooBig)
+	}
+}
+
+// 帧头还没有全部到达时返回0，等待更多的内容，不能报错
+func TestDecodeHeaderShortBuffer(t *testing.T) {
+	var e frameEncoder
+	key := [4]byte{1, 2, 3, 4}
+	for _, length := range []int64{maxPayloadLen7, maxPayloadLen16, maxPayloadLen16 + 1} {
+		header := maskFrame(e.encodeHeader(nil, &frame{fin: true, opcode: TextMessage}, length), key)
+		for i := 0; i < len(header); i++ {
+			var d frameDecoder
+			_, n, err := d.decodeHeader(header[:i])
+			if n != 0 || err != nil {
+				t.Errorf("length %d, %d of %d header bytes: n = %d, err = %v", length, i, len(header), n, err)
+			}
+		}
+		var d frameDecoder
+		if _, n, err := d.decodeHeader(header); n != len(header) || err != nil {
+			t.Errorf("length %d, full header: n = %d, err = %v", length, n, err)
+		}
+	}
+}
+
+// 关闭帧的内容：没有内容、只有状态码、带原因，以及各种不合法的情况
+func TestParseClosePayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		code    uint16
+		reason  string
+		err     error
+	}{
+		{"empty", nil, CloseNoStatusReceived, "", nil},
+		{"code only", []byte{0x03, 0xe8}, CloseNormalClosure, "", nil},
+		{"code and reason", append([]byte{0x03, 0xe9}, "bye"...), CloseGoingAway, "bye", nil},
+		{"application code", []byte{0x0f, 0xa0}, 4000, "", nil},
+		{"one byte", []byte{0x03}, 0, "", errInvalidClosePayload},
+		{"1005 on the wire", []byte{0x03, 0xed}, 0, "", errInvalidCloseCode},
+		{"1006 on the wire", []byte{0x03, 0xee}, 0, "", errInvalidCloseCode},
+		{"1015 on the wire", []byte{0x03, 0xf7}, 0, "", errInvalidCloseCode},
+		{"unassigned 1016", []byte{0x03, 0xf8}, 0, "", errInvalidCloseCode},
+		{"below 1000", []byte{0x03, 0xe7}, 0, "", errInvalidCloseCode},
+		{"above 4999", []byte{0x13, 0x88}, 0, "", errInvalidCloseCode},
+		{"invalid utf8 reason", []byte{0x03, 0xe8, 0xff}, 0, "", errInvalidUTF8},
+	}
+	for _, tt := range tests {
+		code, reason, err := parseClosePayload(tt.payload)
+		if err != tt.err {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if code != tt.code || string(reason) != tt.reason {
+			t.Errorf("%s: got %d %q, want %d %q", tt.name, code, reason, tt.code, tt.reason)
+		}
+	}
+}
+
+// 分段校验UTF-8，多字节字符在任意位置被拆开时结果和整体校验一致
+func TestUTF8Validator(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		valid bool
+	}{
+		{"ascii", "hello", true},
+		{"two bytes", "héllo", true},
+		{"three bytes", "你好，世界", true},
+		{"four bytes", "emoji 😀 end", true},
+		{"invalid byte", "abc\xffdef", false},
+		{"surrogate", "\xed\xa0\x80", false},
+		{"overlong", "\xc0\xaf", false},
+		{"truncated at end", "abc\xe4\xbd", false},
+	}
+	for _, tt := range tests {
+		b := []byte(tt.input)
+		for i := 0; i <= len(b); i++ {
+			for j := i; j <= len(b); j++ {
+				var v utf8Validator
+				ok := v.write(b[:i]) && v.write(b[i:j]) && v.write(b[j:]) && v.done()
+				if ok != tt.valid {
+					t.Errorf("%s split at %d,%d: valid = %v, want %v", tt.name, i, j, ok, tt.valid)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package gof
+
+import (
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 握手的默认超时时间（秒）
+const defaultHandshakeTimeout = 10
+
+// handshake 一个还没有完成握手的连接。握手请求由epoll通知可读之后非阻塞地读取，
+// 请求不完整时等待下一次通知，不会阻塞epoll的协程
+type handshake struct {
+	mu     sync.Mutex
+	fd     int
+	addr   net.Addr
+	parser *requestParser
+	start  time.Time //接受连接的时间，超过 handshakeTimeout 还没有收到完整的请求时关闭
+	done   bool      //已经收到完整的请求，或者已经关闭
+}
+
+// @Description //接受连接之后开始握手，客户端可能已经发送了请求，先尝试读取一次
+// @Param fd 客户端的fd addr 客户端的地址
+func (s *Server) beginHandshake(fd int, addr net.Addr) {
+	h := &handshake{
+		fd:     fd,
+		addr:   addr,
+		parser: newRequestParser(s.maxHeaderSize),
+		start:  time.Now(),
+	}
+	s.handshakes.Store(fd, h)
+	s.readHandshake(h)
+}
+
+// @Description //读取fd上已经到达的内容，收到完整的请求之后在新的协程中完成握手
+// @Param h 还没有完成握手的连接
+func (s *Server) readHandshake(h *handshake) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.done {
+		return
+	}
+	var buf [1024]byte
+	for {
+		n, err := syscall.Read(h.fd, buf[:])
+		if n > 0 {
+			r, rest, err := h.parser.feed(buf[:n])
+			if err == nil && r == nil { //请求还不完整
+				continue
+			}
+			h.done = true
+			s.handshakes.Delete(h.fd)
+			if err != nil {
+				go s.rejectHandshake(h.fd, err)
+				return
+			}
+			r.remoteAddr = h.addr
+			//Upgrade、OnHandshake 和普通HTTP接口可能比较慢，不能在epoll的协程中执行
+			go s.handShaker(h.fd, r, rest)
+			return
+		}
+		switch err {
+		case syscall.EINTR:
+		case syscall.EAGAIN: //已经读完，等待epoll的下一次通知
+			return
+		default:
+			if err == nil { //客户端在发送完请求之前关闭了连接
+				err = io.ErrUnexpectedEOF
+			}
+			Log.Error("read handshake request from fd %d err: %+v", h.fd, err.Error())
+			h.done = true
+			s.handshakes.Delete(h.fd)
+			s.closeHandshakeFd(h.fd)
+			return
+		}
+	}
+}
+
+// rejectHandshake 请求不合法时回复HTTP错误并关闭fd
+func (s *Server) rejectHandshake(fd int, err error) {
+	Log.Error("read handshake request from fd %d err: %+v", fd, err.Error())
+	if err := s.upgrader.writeError(fd, err, time.Duration(s.connectionTimeout)*time.Second); err != nil {
+		Log.Error("send handshake error to fd %d err: %+v", fd, err.Error())
+	}
+	s.closeHandshakeFd(fd)
+}
+
+// @Description //定时关闭超过 handshakeTimeout 还没有发送完整握手请求的连接
+func (s *Server) checkHandshakeTimeOut() {
+	go func() {
+		timeout := time.Duration(s.handshakeTimeout) * time.Second
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-time.After(time.Second):
+			}
+			s.handshakes.Range(func(k, v interface{}) bool {
+				h := v.(*handshake)
+				if time.Since(h.start) < timeout {
+					return true
+				}
+				h.mu.Lock()
+				if !h.done {
+					Log.Info("fd 为 %d 的连接握手超时", h.fd)
+					h.done = true
+					s.handshakes.Delete(h.fd)
+					s.closeHandshakeFd(h.fd)
+				}
+				h.mu.Unlock()
+				return true
+			})
+		}
+	}()
+}
+
+// closeHandshakes 服务关闭时关闭所有还没有完成握手的连接
+func (s *Server) closeHandshakes() {
+	s.handshakes.Range(func(k, v interface{}) bool {
+		h := v.(*handshake)
+		h.mu.Lock()
+		if !h.done {
+			h.done = true
+			s.handshakes.Delete(h.fd)
+			s.closeHandshakeFd(h.fd)
+		}
+		h.mu.Unlock()
+		return true
+	})
+}
@@ -0,0 +1,193 @@
+package gof
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// 普通HTTP请求的请求体的默认最大长度
+const defaultMaxHTTPBodySize = 1 << 20
+
+var (
+	errBodyTooLarge   = HandshakeError{status: http.StatusRequestEntityTooLarge, message: "websocket: request body too large"}
+	errLengthRequired = HandshakeError{status: http.StatusLengthRequired, message: "websocket: chunked request body is not supported"}
+	errBadLength      = HandshakeError{status: http.StatusBadRequest, message: "websocket: invalid Content-Length"}
+)
+
+// @Description //注册一个普通的HTTP接口，和 WebSocket 共用同一个端口，比如负载均衡的健康检查 /healthz。
+// 不是 WebSocket 握手的请求按照 http.ServeMux 的规则匹配，没有匹配时回复404，回复之后关闭连接。需要在 Run 之前调用
+// @Param pattern http.ServeMux 的路径 handler 处理请求的 http.Handler
+func (s *Server) HandleHTTP(pattern string, handler http.Handler) {
+	if s.httpMux == nil {
+		s.httpMux = http.NewServeMux()
+	}
+	s.httpMux.Handle(pattern, handler)
+}
+
+// @Description //注册了HTTP接口时，不是 WebSocket 握手的请求在新的协程中交给 http.Handler 处理
+// @Param fd 客户端的fd r 请求 rest 请求头之后已经读取的内容
+// @return 请求是否已经作为普通HTTP请求处理
+func (s *Server) serveHTTP(fd int, r *Request, rest []byte) bool {
+	if s.httpMux == nil || headerContainsToken(r.header, "Upgrade", "websocket") {
+		return false
+	}
+	req := r.httpRequest()
+	h, _ := s.httpMux.Handler(req) //没有匹配的接口时 http.ServeMux 回复404
+	go func() {
+		defer s.closeHandshakeFd(fd)
+		timeout := time.Duration(s.connectionTimeout) * time.Second
+		body, err := readBody(fd, req, rest, timeout)
+		if err != nil {
+			Log.Error("read http request body from fd %d err: %+v", fd, err.Error())
+			if _, ok := err.(HandshakeError); ok {
+				_ = s.upgrader.writeError(fd, err, timeout)
+			}
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		w := &responseWriter{header: make(http.Header)}
+		serveHandler(h, w, req)
+		if err := writeFd(fd, w.bytes(req.Method), timeout); err != nil {
+			Log.Error("send http response to fd %d err: %+v", fd, err.Error())
+		}
+	}()
+	return true
+}
+
+// serveHandler 调用 http.Handler，handler panic 时回复500
+func serveHandler(h http.Handler, w *responseWriter, req *http.Request) {
+	defer func() {
+		if err := recover(); err != nil {
+			Log.Error("http handler for %s panic: %+v", req.URL.Path, err)
+			w.header = make(http.Header)
+			w.status = http.StatusInternalServerError
+			w.body.Reset()
+		}
+	}()
+	h.ServeHTTP(w, req)
+}
+
+// httpRequest 转换为 http.Handler 使用的 *http.Request，请求体由调用方设置
+func (r *Request) httpRequest() *http.Request {
+	u := &url.URL{Path: r.path, RawQuery: r.rawQuery}
+	req := &http.Request{
+		Method:     r.method,
+		URL:        u,
+		Proto:      r.proto,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     r.header,
+		Body:       http.NoBody,
+		Host:       r.header.Get("Host"),
+		RequestURI: u.RequestURI(),
+		Close:      true,
+	}
+	if r.remoteAddr != nil {
+		req.RemoteAddr = r.remoteAddr.String()
+	}
+	return req
+}
+
+// @Description //按照 Content-Length 读取请求体，不支持 chunked
+// @Param fd 客户端的fd req 请求 rest 请求头之后已经读取的内容 timeout 等待客户端发送的时间
+// @return 请求体
+func readBody(fd int, req *http.Request, rest []byte, timeout time.Duration) ([]byte, error) {
+	if len(req.Header["Transfer-Encoding"]) > 0 {
+		return nil, errLengthRequired
+	}
+	cl := req.Header.Get("Content-Length")
+	if cl == "" {
+		return nil, nil
+	}
+	n, err := strconv.ParseInt(cl, 10, 64)
+	if err != nil || n < 0 {
+		return nil, errBadLength
+	}
+	if n > defaultMaxHTTPBodySize {
+		return nil, errBodyTooLarge
+	}
+	req.ContentLength = n
+	body := make([]byte, 0, n)
+	body = append(body, rest[:min64(int64(len(rest)), n)]...)
+	buf := make([]byte, 1024)
+	for int64(len(body)) < n {
+		m, err := syscall.Read(fd, buf[:min64(int64(len(buf)), n-int64(len(body)))])
+		if m > 0 {
+			body = append(body, buf[:m]...)
+			continue
+		}
+		switch err {
+		case nil:
+			return nil, errBadLength
+		case syscall.EINTR:
+		case syscall.EAGAIN:
+			if err := waitReadable(fd, timeout); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// responseWriter 缓存 http.Handler 的回复，handler 返回之后一次性写入fd
+type responseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
+
+// bytes 生成完整的HTTP响应，每个请求回复之后都关闭连接
+func (w *responseWriter) bytes(method string) []byte {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.header.Get("Content-Type") == "" && w.body.Len() > 0 {
+		w.header.Set("Content-Type", http.DetectContentType(w.body.Bytes()))
+	}
+	w.header.Set("Content-Length", strconv.Itoa(w.body.Len()))
+	w.header.Set("Connection", "close")
+	if w.header.Get("Date") == "" {
+		w.header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	var b bytes.Buffer
+	b.WriteString("HTTP/1.1 ")
+	b.WriteString(strconv.Itoa(w.status))
+	b.WriteByte(' ')
+	b.WriteString(http.StatusText(w.status))
+	b.WriteString("\r\n")
+	_ = w.header.Write(&b)
+	b.WriteString("\r\n")
+	if method != http.MethodHead {
+		b.Write(w.body.Bytes())
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,184 @@
+package gof
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+)
+
+// 握手请求头的默认最大长度
+const defaultMaxHeaderSize = 8 * 1024
+
+var (
+	errHeaderTooLarge  = HandshakeError{status: http.StatusRequestHeaderFieldsTooLarge, message: "websocket: request header too large"}
+	errBadRequestLine  = HandshakeError{status: http.StatusBadRequest, message: "websocket: malformed request line"}
+	errBadHTTPVersion  = HandshakeError{status: http.StatusBadRequest, message: "websocket: unsupported HTTP version"}
+	errBadRequestURI   = HandshakeError{status: http.StatusBadRequest, message: "websocket: malformed request target"}
+	errBadHeaderFormat = HandshakeError{status: http.StatusBadRequest, message: "websocket: malformed request header"}
+)
+
+// 请求头以一个空行结束
+var headerEnd = []byte("\r\n\r\n")
+
+// Request 客户端发送的握手请求，握手完成之后通过 Conn.Request 获取，内容不能修改
+type Request struct {
+	method     string
+	path       string
+	rawQuery   string
+	proto      string
+	header     http.Header       //请求头，名称不区分大小写，同名的请求头保留全部的值
+	remoteAddr net.Addr          //客户端的地址
+	params     map[string]string //路由匹配出的路径参数
+}
+
+// Method 请求方法，握手请求一定是GET
+func (r *Request) Method() string {
+	return r.method
+}
+
+// Path 请求的路径，已经解码
+func (r *Request) Path() string {
+	return r.path
+}
+
+// RawQuery 请求的原始查询字符串，不包含问号
+func (r *Request) RawQuery() string {
+	return r.rawQuery
+}
+
+// Query 解析之后的查询参数，每次调用都返回新的副本
+func (r *Request) Query() url.Values {
+	values, _ := url.ParseQuery(r.rawQuery)
+	return values
+}
+
+// Proto 请求的协议版本，比如 HTTP/1.1
+func (r *Request) Proto() string {
+	return r.proto
+}
+
+// Header 返回请求头的副本，修改副本不会影响连接上保存的请求
+func (r *Request) Header() http.Header {
+	return r.header.Clone()
+}
+
+// HeaderValue 返回名称为name的第一个请求头，名称不区分大小写
+func (r *Request) HeaderValue(name string) string {
+	return r.header.Get(name)
+}
+
+// Cookies 解析请求中的全部cookie
+func (r *Request) Cookies() []*http.Cookie {
+	return (&http.Request{Header: r.header}).Cookies()
+}
+
+// Cookie 返回名称为name的cookie，不存在时返回 http.ErrNoCookie
+func (r *Request) Cookie(name string) (*http.Cookie, error) {
+	return (&http.Request{Header: r.header}).Cookie(name)
+}
+
+// Param 返回路由中名称为name的路径参数，比如 /rooms/:id 中的 id，不存在时返回空字符串
+func (r *Request) Param(name string) string {
+	return r.params[name]
+}
+
+// RemoteAddr 客户端的地址
+func (r *Request) RemoteAddr() net.Addr {
+	return r.remoteAddr
+}
+
+// requestParser 增量解析握手请求，请求行和请求头可以分多次到达
+type requestParser struct {
+	maxSize int    //请求行和请求头的最大长度
+	buf     []byte //已经收到的内容
+	scanned int    //已经查找过结束标记的长度，下次从这里继续查找
+}
+
+func newRequestParser(maxSize int) *requestParser {
+	return &requestParser{maxSize: maxSize}
+}
+
+// @Description //追加新读取的内容，收到完整的请求头之后解析请求
+// @Param b 新读取的内容
+// @return 请求头还不完整时返回nil；请求头之后多出来的内容（客户端在握手之后紧接着发送的帧）
+func (p *requestParser) feed(b []byte) (*Request, []byte, error) {
+	p.buf = append(p.buf, b...)
+	//结束标记可能被拆在两次读取之间，往前多找几个字节
+	start := p.scanned - len(headerEnd) + 1
+	if start < 0 {
+		start = 0
+	}
+	i := bytes.Index(p.buf[start:], headerEnd)
+	if i < 0 {
+		if len(p.buf) > p.maxSize {
+			return nil, nil, errHeaderTooLarge
+		}
+		p.scanned = len(p.buf)
+		return nil, nil, nil
+	}
+	end := start + i + len(headerEnd)
+	if end > p.maxSize {
+		return nil, nil, errHeaderTooLarge
+	}
+	r, err := parseRequest(p.buf[:end])
+	if err != nil {
+		return nil, nil, err
+	}
+	return r, p.buf[end:], nil
+}
+
+// @Description //解析完整的请求行和请求头
+// @Param b 以空行结束的请求行和请求头
+// @return
+func parseRequest(b []byte) (*Request, error) {
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(b)))
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, errBadRequestLine
+	}
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 || parts[0] == "" {
+		return nil, errBadRequestLine
+	}
+	//RFC 6455 4.1，握手请求至少是 HTTP/1.1
+	major, minor, ok := http.ParseHTTPVersion(parts[2])
+	if !ok || major != 1 || minor < 1 {
+		return nil, errBadHTTPVersion
+	}
+	u, err := url.ParseRequestURI(parts[1])
+	if err != nil {
+		return nil, errBadRequestURI
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, errBadHeaderFormat
+	}
+	return &Request{
+		method:   parts[0],
+		path:     u.Path,
+		rawQuery: u.RawQuery,
+		proto:    parts[2],
+		header:   http.Header(header),
+	}, nil
+}
+
+// headerContainsToken 请求头中以逗号分隔的值是否包含token，不区分大小写，同名的请求头都会查找
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, v := range header[textproto.CanonicalMIMEHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// headerValues 同名请求头的全部值，以逗号连接
+func headerValues(header http.Header, name string) string {
+	return strings.Join(header[textproto.CanonicalMIMEHeaderKey(name)], ",")
+}
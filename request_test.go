@@ -0,0 +1,112 @@
+package gof
+
+import (
+	"strings"
+	"testing"
+)
+
+const testRequest = "GET /chat?room=1 HTTP/1.1\r\n" +
+	"Host: example.com\r\n" +
+	"upgrade: websocket\r\n" +
+	"Connection: Upgrade\r\n" +
+	"\r\n"
+
+// 请求头在任意位置被拆成两次到达，包括结束标记 \r\n\r\n 被拆开，都能解析出同样的请求，多出来的内容原样返回
+func TestRequestParserSplit(t *testing.T) {
+	input := testRequest + "frame"
+	for i := 0; i <= len(input); i++ {
+		p := newRequestParser(defaultMaxHeaderSize)
+		r, rest, err := p.feed([]byte(input[:i]))
+		if err != nil {
+			t.Fatalf("split at %d: first feed err: %v", i, err)
+		}
+		if r == nil {
+			r, rest, err = p.feed([]byte(input[i:]))
+			if err != nil || r == nil {
+				t.Fatalf("split at %d: second feed = %v, %v", i, r, err)
+			}
+		} else if i < len(testRequest) {
+			t.Fatalf("split at %d: request parsed before the header end", i)
+		}
+		if r.Method() != "GET" || r.Path() != "/chat" || r.RawQuery() != "room=1" || r.HeaderValue("Upgrade") != "websocket" {
+			t.Errorf("split at %d: got %s %s?%s upgrade=%q", i, r.Method(), r.Path(), r.RawQuery(), r.HeaderValue("Upgrade"))
+		}
+		want := "frame"
+		if i >= len(testRequest) {
+			want = input[len(testRequest):i] //第一次就收到了完整的请求头
+		}
+		if string(rest) != want {
+			t.Errorf("split at %d: rest = %q, want %q", i, rest, want)
+		}
+	}
+}
+
+// 一个字节一个字节地到达，结束标记的每个字节都在单独的一次读取中
+func TestRequestParserByteByByte(t *testing.T) {
+	p := newRequestParser(defaultMaxHeaderSize)
+	for i := 0; i < len(testRequest); i++ {
+		r, _, err := p.feed([]byte{testRequest[i]})
+		if err != nil {
+			t.Fatalf("byte %d: err %v", i, err)
+		}
+		if (r != nil) != (i == len(testRequest)-1) {
+			t.Fatalf("byte %d: request = %v", i, r)
+		}
+	}
+}
+
+// 请求头超过 maxSize 时返回431，不管结束标记有没有到达
+func TestRequestParserHeaderTooLarge(t *testing.T) {
+	size := len(testRequest)
+	tests := []struct {
+		name    string
+		maxSize int
+		input   []string
+		tooBig  bool
+	}{
+		{"exactly max size", size, []string{testRequest}, false},
+		{"complete but one byte over", size - 1, []string{testRequest}, true},
+		{"no end yet and over", 16, []string{testRequest[:17]}, true},
+		{"over across feeds", 16, []string{testRequest[:10], testRequest[10:20]}, true},
+		{"end arrives after max size", size - 1, []string{testRequest[:size-2], testRequest[size-2:]}, true},
+		{"long header line", 64, []string{"GET / HTTP/1.1\r\nX-Long: " + strings.Repeat("a", 64)}, true},
+	}
+	for _, tt := range tests {
+		p := newRequestParser(tt.maxSize)
+		var err error
+		for _, in := range tt.input {
+			if _, _, err = p.feed([]byte(in)); err != nil {
+				break
+			}
+		}
+		if !tt.tooBig {
+			if err != nil {
+				t.Errorf("%s: err = %v", tt.name, err)
+			}
+			continue
+		}
+		he, ok := err.(HandshakeError)
+		if !ok || he.Status() != errHeaderTooLarge.Status() {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, errHeaderTooLarge)
+		}
+	}
+}
+
+// 请求行和请求头格式不对时回复400
+func TestParseRequestMalformed(t *testing.T) {
+	tests := []struct {
+		input string
+		err   HandshakeError
+	}{
+		{"GET /\r\n\r\n", errBadRequestLine},
+		{"GET / HTTP/1.0\r\n\r\n", errBadHTTPVersion},
+		{"GET chat HTTP/1.1\r\n\r\n", errBadRequestURI},
+		{"GET / HTTP/1.1\r\nno colon\r\n\r\n", errBadHeaderFormat},
+	}
+	for _, tt := range tests {
+		_, err := parseRequest([]byte(tt.input))
+		if he, ok := err.(HandshakeError); !ok || he.Error() != tt.err.Error() {
+			t.Errorf("parseRequest(%q) err = %v, want %v", tt.input, err, tt.err)
+		}
+	}
+}
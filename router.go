@@ -0,0 +1,115 @@
+package gof
+
+import (
+	"net/http"
+	"strings"
+)
+
+var errNotFound = HandshakeError{status: http.StatusNotFound, message: "websocket: no handler for request path"}
+
+// route 一个注册的路径
+type route struct {
+	pattern  string
+	segments []string //按 / 分隔的每一段，以 : 开头的段是路径参数
+	prefix   bool     //以 / 结尾的路径按前缀匹配
+	params   bool     //是否包含路径参数
+	statics  int      //不是路径参数的段数，匹配多个带参数的路径时优先选择更具体的
+	handle   WebSocketInterface
+}
+
+// router 握手时按请求的路径选择handle，
+// 优先级为：完全匹配的路径 > 带参数的路径（不是参数的段越多越优先）> 最长的前缀
+type router struct {
+	routes []*route
+}
+
+// @Description //注册一个路径，pattern 以 / 结尾时按前缀匹配，以 : 开头的段是路径参数，比如 /rooms/:id
+// @Param pattern 路径 handle 处理这个路径的handle
+func (rt *router) add(pattern string, handle WebSocketInterface) {
+	if pattern == "" || pattern[0] != '/' {
+		panic("websocket: route pattern must begin with '/': " + pattern)
+	}
+	if handle == nil {
+		panic("websocket: nil handle for route " + pattern)
+	}
+	r := &route{
+		pattern:  pattern,
+		segments: strings.Split(pattern[1:], "/"),
+		prefix:   strings.HasSuffix(pattern, "/"),
+		handle:   handle,
+	}
+	for _, seg := range r.segments {
+		if strings.HasPrefix(seg, ":") {
+			r.params = true
+		} else {
+			r.statics++
+		}
+	}
+	if r.prefix && r.params {
+		panic("websocket: prefix route cannot have parameters: " + pattern)
+	}
+	for i, old := range rt.routes {
+		if old.pattern == pattern { //重复注册时替换原来的handle
+			rt.routes[i] = r
+			return
+		}
+	}
+	rt.routes = append(rt.routes, r)
+}
+
+// @Description //按请求的路径查找handle
+// @Param path 请求的路径
+// @return 匹配的handle，路径参数；没有匹配的路径时返回false
+func (rt *router) match(path string) (WebSocketInterface, map[string]string, bool) {
+	var (
+		best       *route
+		bestParams map[string]string
+	)
+	for _, r := range rt.routes {
+		switch {
+		case r.prefix:
+			if !strings.HasPrefix(path, r.pattern) {
+				continue
+			}
+			if best == nil || best.prefix && len(r.pattern) > len(best.pattern) {
+				best = r
+			}
+		case r.params:
+			params, ok := r.matchParams(path)
+			if !ok {
+				continue
+			}
+			if best == nil || best.prefix || r.statics > best.statics {
+				best, bestParams = r, params
+			}
+		default:
+			if path == r.pattern {
+				return r.handle, nil, true
+			}
+		}
+	}
+	if best == nil {
+		return nil, nil, false
+	}
+	return best.handle, bestParams, true
+}
+
+// matchParams 带参数的路径必须段数相同，不是参数的段完全相同，参数不能为空
+func (r *route) matchParams(path string) (map[string]string, bool) {
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(segments) != len(r.segments) {
+		return nil, false
+	}
+	params := make(map[string]string)
+	for i, seg := range r.segments {
+		if strings.HasPrefix(seg, ":") {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[seg[1:]] = segments[i]
+		} else if seg != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
@@ -0,0 +1,115 @@
+package gof
+
+import (
+	"reflect"
+	"testing"
+)
+
+// testHandle 测试用的handle，用名字区分匹配到了哪个路径
+type testHandle string
+
+func (testHandle) OnConnect(c *Conn)                           {}
+func (testHandle) OnMessage(c *Conn, bytes []byte)             {}
+func (testHandle) OnClose(c *Conn, code uint16, reason []byte) {}
+
+// 完全匹配 > 带参数的路径（不是参数的段越多越优先）> 最长的前缀，注册的顺序不影响结果
+func TestRouterMatch(t *testing.T) {
+	var rt router
+	for _, pattern := range []string{
+		"/",
+		"/static/",
+		"/static/deep/",
+		"/rooms/:id",
+		"/rooms/:id/:sub",
+		"/rooms/:id/members",
+		"/rooms/lobby",
+		"/chat",
+	} {
+		rt.add(pattern, testHandle(pattern))
+	}
+	tests := []struct {
+		path   string
+		want   string //为空时表示没有匹配的路径
+		params map[string]string
+	}{
+		{"/chat", "/chat", nil},
+		{"/chat/", "/", nil},
+		{"/rooms/lobby", "/rooms/lobby", nil},
+		{"/rooms/42", "/rooms/:id", map[string]string{"id": "42"}},
+		{"/rooms/42/members", "/rooms/:id/members", map[string]string{"id": "42"}},
+		{"/rooms/42/admins", "/rooms/:id/:sub", map[string]string{"id": "42", "sub": "admins"}},
+		{"/rooms/", "/", nil}, //参数不能为空
+		{"/static/a.js", "/static/", nil},
+		{"/static/deep/b.js", "/static/deep/", nil},
+		{"/static", "/", nil},
+		{"/nope", "/", nil},
+	}
+	for _, tt := range tests {
+		h, params, ok := rt.match(tt.path)
+		if !ok {
+			t.Errorf("match(%q) not found, want %q", tt.path, tt.want)
+			continue
+		}
+		if string(h.(testHandle)) != tt.want || !reflect.DeepEqual(params, tt.params) {
+			t.Errorf("match(%q) = %q %v, want %q %v", tt.path, h, params, tt.want, tt.params)
+		}
+	}
+}
+
+// 没有注册 "/" 时，没有匹配的路径返回false，由 Upgrade 回复404
+func TestRouterNoMatch(t *testing.T) {
+	var rt router
+	rt.add("/chat", testHandle("chat"))
+	rt.add("/rooms/:id", testHandle("room"))
+	for _, path := range []string{"/", "/chat/x", "/rooms", "/rooms/1/2"} {
+		if h, _, ok := rt.match(path); ok {
+			t.Errorf("match(%q) = %q, want no match", path, h)
+		}
+	}
+}
+
+// 重复注册同一个路径时替换原来的handle
+func TestRouterReplace(t *testing.T) {
+	var rt router
+	rt.add("/chat", testHandle("old"))
+	rt.add("/chat", testHandle("new"))
+	if h, _, _ := rt.match("/chat"); h != testHandle("new") {
+		t.Errorf("match(/chat) = %v, want new", h)
+	}
+	if len(rt.routes) != 1 {
+		t.Errorf("routes = %d, want 1", len(rt.routes))
+	}
+}
+
+// 路径优先于子协议：注册了路径时子协议的handle不生效，没有注册路径时才按子协议选择
+func TestSelectHandlePrecedence(t *testing.T) {
+	req := func(path string) *Request {
+		r, err := parseRequest([]byte("GET " + path + " HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+		if err != nil {
+			t.Fatalf("parseRequest(%q) err: %v", path, err)
+		}
+		return r
+	}
+
+	s := &Server{handle: testHandle("default"), upgrader: &Upgrader{}}
+	s.HandleSubprotocol("v1.chat", testHandle("v1.chat"))
+	if h, _ := s.selectHandle(req("/chat"), "v1.chat"); h != testHandle("v1.chat") {
+		t.Errorf("no routes, subprotocol v1.chat: handle = %v, want v1.chat", h)
+	}
+	if h, _ := s.selectHandle(req("/chat"), ""); h != testHandle("default") {
+		t.Errorf("no routes, no subprotocol: handle = %v, want default", h)
+	}
+
+	s.Handle("/rooms/:id", testHandle("room"))
+	r := req("/rooms/42")
+	if h, err := s.selectHandle(r, "v1.chat"); h != testHandle("room") || err != nil {
+		t.Errorf("routed, subprotocol v1.chat: handle = %v, err = %v, want room", h, err)
+	}
+	if r.Param("id") != "42" {
+		t.Errorf("Param(id) = %q, want 42", r.Param("id"))
+	}
+	_, err := s.selectHandle(req("/chat"), "v1.chat")
+	if he, ok := err.(HandshakeError); !ok || he.Status() != errNotFound.Status() {
+		t.Errorf("routed, no match: err = %v, want %v", err, errNotFound)
+	}
+}
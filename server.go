@@ -1,13 +1,15 @@
 package gof
 
 import (
-	"bytes"
 	"compress/flate"
-	"encoding/binary"
+	"errors"
 	"fmt"
-	"os"
+	"io"
+	"net"
+	"net/http"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -19,10 +21,36 @@ type WebSocketInterface interface {
 	OnClose(c *Conn, code uint16, reason []byte) //连接关闭时的回调
 }
 
+// ErrorInterface 可选接口，连接因为协议错误、消息过大等原因被服务端关闭时回调 OnError，
+// err 为 *CloseError。OnError 在读取连接的协程中执行，不能阻塞
+type ErrorInterface interface {
+	OnError(c *Conn, err error)
+}
+
+// MessageReaderInterface 可选接口，handle 实现了这个接口时，数据消息不再回调 OnMessage，
+// 而是在消息的第一帧到达时在新的协程中回调 OnMessageReader，消息内容随着帧的到达从 r 中读出，
+// 适合接收很大的消息。同一个连接的 OnMessageReader 按消息的顺序依次回调，上一条返回之后才会回调下一条。
+// 业务方读取得慢时会暂停读取该连接，OnMessageReader 返回之后没有读完的内容会被丢弃
+type MessageReaderInterface interface {
+	OnMessageReader(c *Conn, messageType int, r io.Reader)
+}
+
+// HandshakeInterface 可选接口，handle 实现了这个接口时，握手请求校验通过之后、回复101之前回调 OnHandshake，
+// 可以在这里校验token、cookie。返回的 header 会加到101的响应中（比如 Set-Cookie）；
+// 返回错误时拒绝握手，用 RejectHandshake 可以指定回复的HTTP状态码，其它错误回复403，
+// 拒绝时返回的 header 会加到错误的响应中（比如 WWW-Authenticate）
+type HandshakeInterface interface {
+	OnHandshake(r *Request) (header http.Header, err error)
+}
+
+// ErrServerClosed 调用 Server.Close 之后 Run 返回的错误
+var ErrServerClosed = errors.New("websocket: server closed")
+
 type Server struct {
 	ep                *EpollObj
 	conns             sync.Map //当前的所有连接
 	checkTimeOutTree  *AVLTree
+	timeOutMu         sync.Mutex //checkTimeOutTree 会在多个协程中读写
 	receiveFdBytes    chan *Conn
 	handle            WebSocketInterface
 	readMessageChan   chan *Message
@@ -35,20 +63,103 @@ type Server struct {
 	messagePool       *sync.Pool //Message的池子，用于接收消息并返给服务端
 	isComporessOn     bool
 	compressLevel     int
-	writeMessageChan  chan *Message
+	compressThreshold int        //小于这个长度的消息不压缩
+	pushChan          chan *Conn //消息队列中有内容需要发送的连接，同一个连接同一时间只会在一个push协程中
+	encoder           frameEncoder
+	pingInterval      int64 //服务端发送ping的间隔（秒），为0时不发送
+	maxMissedPongs    int32 //连续多少次没有收到pong就关闭连接
+	closeTimeout      int64 //主动关闭连接时等待对端回复关闭帧的时间（秒）
+	maxMessageSize    int64 //单条消息的最大长度，为0时不限制
+	maxFrameSize      int64 //单个帧的最大长度，为0时不限制
+	upgrader          *Upgrader
+	maxHeaderSize     int                           //握手请求头的最大长度
+	protocolHandles   map[string]WebSocketInterface //按子协议分发的handle
+	router            router                        //按请求路径分发的handle
+	httpMux           *http.ServeMux                //和 WebSocket 共用端口的普通HTTP接口
+	handshakes        sync.Map                      //还没有完成握手的连接，fd -> *handshake
+	handshakeTimeout  int64                         //握手的超时时间（秒）
+	maxWriteQueueSize int64                         //每个连接发送队列的上限
+	done              chan struct{}                 //Close 之后关闭，后台的协程都会退出
+	runDone           chan struct{}                 //Run 返回之后关闭
+	stateMu           sync.Mutex                    //保护 running 和 closed
+	running           bool                          //是否调用过 Run
+	closed            bool                          //是否调用过 Close
+}
+
+// @Description //注册一个路径，握手请求的路径匹配时交给handle处理，需要在 Run 之前调用。
+// pattern 以 / 结尾时按前缀匹配，以 : 开头的段是路径参数（比如 /rooms/:id），可以通过 Request.Param 获取。
+// 注册了路径之后没有匹配的路径回复404，不再交给 InitServer 传入的handle，需要兜底时可以注册 "/"。
+// 路径优先于子协议：注册了路径之后 HandleSubprotocol 注册的handle不再生效，子协议只参与协商，可以在handle中通过 Conn.Subprotocol 区分
+// @Param pattern 路径 handle 处理这个路径的handle
+func (s *Server) Handle(pattern string, handle WebSocketInterface) {
+	s.router.add(pattern, handle)
+}
+
+// @Description //注册一个子协议，握手时协商出这个子协议的连接交给handle处理，需要在 Run 之前调用。
+// 只在没有通过 Handle 注册路径时生效，注册了路径时由路径选择handle
+// @Param protocol 子协议 handle 处理这个子协议的handle，按注册的顺序决定子协议的优先级
+func (s *Server) HandleSubprotocol(protocol string, handle WebSocketInterface) {
+	if s.protocolHandles == nil {
+		s.protocolHandles = make(map[string]WebSocketInterface)
+	}
+	s.protocolHandles[protocol] = handle
+	for _, p := range s.upgrader.Subprotocols {
+		if p == protocol { //已经在 Conf.Subprotocols 中或者注册过
+			return
+		}
+	}
+	s.upgrader.Subprotocols = append(s.upgrader.Subprotocols, protocol)
+}
+
+// selectHandle 选择处理连接的handle：注册了路径时只按路径选择，没有匹配的路径回复404；
+// 没有注册路径时，协商出的子协议注册过handle就交给它，否则交给 InitServer 传入的handle
+func (s *Server) selectHandle(r *Request, subprotocol string) (WebSocketInterface, error) {
+	if len(s.router.routes) > 0 {
+		h, params, ok := s.router.match(r.path)
+		if !ok {
+			return nil, errNotFound
+		}
+		r.params = params
+		return h, nil
+	}
+	if h, ok := s.protocolHandles[subprotocol]; ok {
+		return h, nil
+	}
+	if s.handle == nil {
+		return nil, errNotFound
+	}
+	return s.handle, nil
 }
 
-func (s *Server) Run() {
+// @Description //启动服务，阻塞直到epoll_wait出错或者调用了 Close
+// @return epoll_wait 返回的错误，调用 Close 之后返回 ErrServerClosed
+func (s *Server) Run() error {
+	s.stateMu.Lock()
+	if s.closed {
+		s.stateMu.Unlock()
+		return ErrServerClosed
+	}
+	s.running = true
+	s.stateMu.Unlock()
+	defer close(s.runDone)
 	s.checkTimeOut() //如果过期，就关闭conn
+	s.checkHandshakeTimeOut()
 	s.checkMessage() //如果有消息，就调用 conn.read方法解包
 	s.getMessage()   //如果有新的消息，就走消息处理的逻辑
 	s.Push()
 	s.closeConn()
-	s.EpollWait()
+	s.heartbeat()
+	return s.EpollWait()
 }
 
-func InitServer(ip string, port int, handle WebSocketInterface, conf *Conf) *Server {
-	ep := InitEpoll(ip, port)
+// @Description //创建服务，监听ip和port
+// @Param ip 监听的地址 port 监听的端口 handle 默认的handle conf 配置，为nil时使用默认配置
+// @return 创建socket、监听端口或者创建epoll失败时返回错误
+func InitServer(ip string, port int, handle WebSocketInterface, conf *Conf) (*Server, error) {
+	ep, err := InitEpoll(ip, port)
+	if err != nil {
+		return nil, err
+	}
 	serv := &Server{
 		ep:                ep,
 		receiveFdBytes:    make(chan *Conn, 1024),
@@ -62,7 +173,14 @@ func InitServer(ip string, port int, handle WebSocketInterface, conf *Conf) *Ser
 		connectionTimeout: 30,
 		isComporessOn:     false,
 		compressLevel:     0,
-		writeMessageChan:  make(chan *Message, 1024),
+		pushChan:          make(chan *Conn, 1024),
+		maxMissedPongs:    3,
+		closeTimeout:      5,
+		maxHeaderSize:     defaultMaxHeaderSize,
+		handshakeTimeout:  defaultHandshakeTimeout,
+		maxWriteQueueSize: defaultMaxWriteQueueSize,
+		done:              make(chan struct{}),
+		runDone:           make(chan struct{}),
 	}
 	if conf != nil {
 		if conf.ReadBufferSize > 0 {
@@ -80,7 +198,40 @@ func InitServer(ip string, port int, handle WebSocketInterface, conf *Conf) *Ser
 			if conf.CompressLevel == 0 {
 				serv.compressLevel = flate.BestCompression
 			}
+			serv.compressThreshold = conf.CompressThreshold
+		}
+		if conf.PingInterval > 0 {
+			serv.pingInterval = conf.PingInterval
+		}
+		if conf.MaxMissedPongs > 0 {
+			serv.maxMissedPongs = int32(conf.MaxMissedPongs)
 		}
+		if conf.CloseTimeOut > 0 {
+			serv.closeTimeout = conf.CloseTimeOut
+		}
+		if conf.MaxMessageSize > 0 {
+			serv.maxMessageSize = conf.MaxMessageSize
+		}
+		if conf.MaxFrameSize > 0 {
+			serv.maxFrameSize = conf.MaxFrameSize
+		}
+		if conf.MaxHeaderSize > 0 {
+			serv.maxHeaderSize = conf.MaxHeaderSize
+		}
+		if conf.HandshakeTimeOut > 0 {
+			serv.handshakeTimeout = conf.HandshakeTimeOut
+		}
+		if conf.MaxWriteQueueSize > 0 {
+			serv.maxWriteQueueSize = conf.MaxWriteQueueSize
+		}
+	}
+
+	serv.upgrader = &Upgrader{EnableCompression: serv.isComporessOn}
+	if conf != nil {
+		serv.upgrader.DisableContextTakeover = conf.CompressNoContextTakeover
+		//HandleSubprotocol 会追加子协议，复制一份，不修改调用方的切片
+		serv.upgrader.Subprotocols = append([]string(nil), conf.Subprotocols...)
+		serv.upgrader.CheckOrigin = conf.CheckOrigin
 	}
 
 	serv.readBufPool = &sync.Pool{New: func() interface{} { return make([]byte, serv.readBufferSize) }}
@@ -91,109 +242,216 @@ func InitServer(ip string, port int, handle WebSocketInterface, conf *Conf) *Ser
 	}}
 	serv.bytePool = &sync.Pool{New: func() interface{} { return make([]byte, 0, serv.writeBufferSize) }}
 
-	return serv
+	return serv, nil
 }
 
-var upgrader = Upgrader{}
-
 // @Author WangKan
 // @Description //当wait方法取到内容后，会回调此方法，对fd进行处理
 // @Date 2021/2/2 21:39
-func (s *Server) handler(fd int, connType ConnStatus) {
+func (s *Server) handler(fd int, connType ConnStatus, events uint32) {
 	switch connType {
 	case CONN_NEW:
-		newFd := s.addConn(fd)
-		//Upgrader to http header
-		s.handShaker(newFd)
+		//监听的fd是边缘触发的，需要一直 accept 到没有新的连接为止
+		for {
+			newFd, sa, err := syscall.Accept(fd)
+			if err != nil {
+				if err == syscall.EINTR || err == syscall.ECONNABORTED { //客户端在accept之前断开，继续取下一个连接
+					continue
+				}
+				if err != syscall.EAGAIN {
+					Log.Error("accept error,fd is %d, err: %+v", fd, err.Error())
+				}
+				break
+			}
+			addr, err := s.addConn(newFd, sa)
+			if err != nil { //只关闭这一个连接
+				Log.Error("add conn fd %d err: %+v", newFd, err.Error())
+				continue
+			}
+			//Upgrader to http header
+			s.beginHandshake(newFd, addr)
+		}
 		//s.messageChan<-newFd
 	case CONN_MESSAGE:
-		Log.Info("接收到描述符为%v的消息", fd)
+		readable := events&^syscall.EPOLLOUT != 0
 		c, ok := s.conns.Load(fd)
 		if !ok {
+			if !readable {
+				return
+			}
+			if h, ok := s.handshakes.Load(fd); ok { //握手请求的后续内容
+				s.readHandshake(h.(*handshake))
+				return
+			}
 			Log.Info("描述符fd 为 %d 的s.conns 不存在！", fd)
 			return
 		}
-		s.receiveFdBytes <- c.(*Conn)
+		if events&syscall.EPOLLOUT != 0 { //fd可写，继续写入发送队列
+			c.(*Conn).flush()
+		}
+		if readable {
+			Log.Info("接收到描述符为%v的消息", fd)
+			s.readConn(c.(*Conn))
+		}
 	default:
 		panic("no connType")
 	}
 }
 
 // @Author WangKan
-// @Description //握手方法，接收conn的头信息，解析并向客户端返回response信息
+// @Description //握手方法，收到完整的握手请求之后校验请求，并向客户端返回response信息
 // @Date 2021/2/2 21:38
-func (s *Server) handShaker(fd int) {
-	header, length := GetHeaderContent(fd)
-	headerMap := FormatHeader(header, length)
-	newConn, err := upgrader.Upgrade(fd, headerMap, s)
+// @Param fd 客户端的fd r 握手请求 rest 请求头之后已经读取的内容
+func (s *Server) handShaker(fd int, r *Request, rest []byte) {
+	timeout := time.Duration(s.connectionTimeout) * time.Second
+	if s.serveHTTP(fd, r, rest) { //不是 WebSocket 握手的普通HTTP请求
+		return
+	}
+	newConn, err := s.upgrader.Upgrade(fd, r, s)
 	if err != nil {
 		Log.Error("upgrade err: %+v", err.Error())
+		if err := s.upgrader.writeError(fd, err, timeout); err != nil {
+			Log.Error("send handshake error to fd %d err: %+v", fd, err.Error())
+		}
+		s.closeHandshakeFd(fd)
 		return
 	}
 	heade := <-newConn.handShake
-	n, err := syscall.Write(fd, heade.Content)
-	Log.Info("send handshaker message n:%+v, err: %+v, fd:%d, newConn:%+v\n", n, err, fd, newConn)
+	err = writeFd(fd, heade.Content, timeout)
+	Log.Info("send handshaker message err: %+v, fd:%d, newConn:%+v\n", err, fd, newConn)
 
 	if err != nil {
 		Log.Error("send handshaker message err: %+v,fd:%d,%+v", err.Error(), fd, newConn)
+		s.closeHandshakeFd(fd)
 		return
 	}
-	s.handle.OnConnect(newConn)
+	newConn.handle.OnConnect(newConn)
+	//客户端在握手请求之后紧接着发送的帧已经被读取了，必须在加入 conns 之前放进 inBuf，
+	//加入之后epoll的通知可能让读取的协程同时访问 inBuf
+	newConn.inBuf = append(newConn.inBuf, rest...)
 	Log.Info("要加入到链接库中的fd:%v", fd)
 	s.conns.Store(fd, newConn)
+	select {
+	case <-s.done: //服务正在关闭，CloseFds 可能已经遍历过 conns
+		s.closeFd(newConn)
+		return
+	default:
+	}
+	//OnConnect 中发送的内容可能没有写完，加入 conns 之前到达的EPOLLOUT已经被忽略，边缘触发不会再通知，需要主动写一次
+	newConn.flush()
+	s.timeOutMu.Lock()
 	s.checkTimeOutTree.Add(newConn.updateTime, fd)
+	s.timeOutMu.Unlock()
+	//握手期间到达的内容epoll也不会再通知，需要主动读取一次
+	s.readConn(newConn)
+}
+
+// closeHandshakeFd 握手没有完成的fd还没有对应的Conn，直接从epoll中删除并关闭
+func (s *Server) closeHandshakeFd(fd int) {
+	if err := s.ep.eDel(fd); err != nil {
+		Log.Error("%+v", err.Error())
+	}
+	_ = syscall.Close(fd)
 }
 
 // @Author WangKan
-// @Description //如果有新的连接，就取出系统中的fd，添加到当前的conns中。
+// @Description //新accept的连接设置为非阻塞并加入epoll，失败时关闭这个fd，不影响其它连接
 // @Date 2021/2/2 21:37
-func (s *Server) addConn(fd int) (newFd int) {
-	newFd, _, err := syscall.Accept(fd)
-	if err != nil {
-		Log.Fatal("accept error,fd is %d", fd)
-		return
-	}
+// @Param fd accept 得到的fd sa 客户端的地址
+// @return 客户端的地址
+func (s *Server) addConn(fd int, sa syscall.Sockaddr) (net.Addr, error) {
 	//设置fd为非阻塞
-	if err := syscall.SetNonblock(newFd, true); err != nil {
-		os.Exit(1)
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		_ = syscall.Close(fd)
+		return nil, fmt.Errorf("websocket: set fd %d nonblock: %w", fd, err)
 	}
 	//把这个链接加入到epoll中
-	s.ep.eAdd(newFd)
-	return
+	if err := s.ep.eAdd(fd, EPOLLCONN); err != nil {
+		_ = syscall.Close(fd)
+		return nil, err
+	}
+	return sockaddrToAddr(sa), nil
 }
 
 // @Author WangKan
 // @Description //wait方法 阻塞式，当epoll中有数据的时候就取出数据并进行处理
 // @Date 2021/2/2 21:37
-func (s *Server) EpollWait() {
+func (s *Server) EpollWait() error {
 	for {
 		err := s.ep.eWait(s.handler)
+		if err == syscall.EINTR { //被信号打断，继续等待
+			continue
+		}
+		if err == ErrServerClosed {
+			return err
+		}
 		if err != nil {
 			Log.Error("epoll wait error: %s", err.Error())
-			continue
+			return fmt.Errorf("websocket: epoll_wait: %w", err)
 		}
 	}
 }
 
+// reportError 如果 handle 实现了 ErrorInterface，就上报连接出错的原因
+func (s *Server) reportError(c *Conn, err error) {
+	if h, ok := c.handle.(ErrorInterface); ok {
+		h.OnError(c, err)
+	}
+}
+
 // @Author WangKan
 // @Description //如果有新的消息进来，就通过当前Conn的read方法去取message 并判断类型
 // @Date 2021/2/2 18:12
 func (s *Server) checkMessage() {
 	go func() {
-		for c := range s.receiveFdBytes {
-			c.Read()
+		for {
+			select {
+			case c := <-s.receiveFdBytes:
+				c.Read()
+			case <-s.done:
+				return
+			}
 		}
 	}()
 }
 
+// readConn 把可以读取的连接交给读取的协程，服务关闭之后直接丢弃
+func (s *Server) readConn(c *Conn) {
+	select {
+	case s.receiveFdBytes <- c:
+	case <-s.done:
+	}
+}
+
+// deliver 把收到的消息交给回调 OnMessage 的协程，服务关闭之后直接丢弃
+func (s *Server) deliver(msg *Message) {
+	select {
+	case s.readMessageChan <- msg:
+	case <-s.done:
+	}
+}
+
+// closeLater 把需要关闭的连接加入关闭队列，服务关闭之后由 Close 统一关闭
+func (s *Server) closeLater(c *Conn) {
+	select {
+	case s.closeChan <- c:
+	case <-s.done:
+	}
+}
+
 // @Author WangKan
 // @Description //如果有新的消息，就走消息处理的逻辑
 // @Date 2021/2/2 18:13
 func (s *Server) getMessage() {
 	go func() {
-		for c := range s.readMessageChan {
-			content := c.Content
-			s.handle.OnMessage(c.Conn, content)
+		for {
+			select {
+			case c := <-s.readMessageChan:
+				content := c.Content
+				c.Conn.handle.OnMessage(c.Conn, content)
+			case <-s.done:
+				return
+			}
 		}
 	}()
 }
@@ -203,9 +461,14 @@ func (s *Server) getMessage() {
 // @Date 2021/2/2 21:36
 func (s *Server) closeConn() {
 	go func() {
-		for c := range s.closeChan {
-			//先从conns中删掉当前的连接
-			s.closeFd(c)
+		for {
+			select {
+			case c := <-s.closeChan:
+				//先从conns中删掉当前的连接
+				s.closeFd(c)
+			case <-s.done:
+				return
+			}
 		}
 	}()
 }
@@ -228,19 +491,17 @@ func (s *Server) checkTimeOut() {
 			//给定一个值，获取小于该值的所有元素
 			timeOutint64 := time.Now().Unix() - s.connectionTimeout
 			//fmt.Println("当前时间：", time.Now().Unix())
+			s.timeOutMu.Lock()
 			expiredKeys := s.checkTimeOutTree.GetLessThanKey(timeOutint64)
+			slice := make([]int, 0, 1024)
+			for _, v := range expiredKeys {
+				slice = append(slice, s.checkTimeOutTree.Get(v)...)
+			}
+			s.timeOutMu.Unlock()
 			//删除conns中的已超时的fd
-			if expiredKeys != nil {
-				for _, v := range expiredKeys {
-					slice := make([]int, 0, 1024)
-					for _, vv := range s.checkTimeOutTree.Get(v) {
-						slice = append(slice, vv)
-					}
-					for i := 0; i < len(slice); i++ {
-						c, _ := s.conns.Load(slice[i])
-						s.closeFd(c.(*Conn))
-					}
-
+			for i := 0; i < len(slice); i++ {
+				if c, ok := s.conns.Load(slice[i]); ok {
+					s.closeFd(c.(*Conn))
 				}
 			}
 			//删除树中已超时的fd
@@ -248,45 +509,139 @@ func (s *Server) checkTimeOut() {
 
 			//fmt.Println(s.checkTimeOutTree.InOrder(-1))
 
-			time.Sleep(time.Second)
+			select {
+			case <-s.done:
+				return
+			case <-time.After(time.Second):
+			}
 			/**********************************更改删除超时连接的结构为平衡二叉树END**********************************/
 		}
 	}()
 }
 
+// @Description //定时向所有连接发送ping，连续 maxMissedPongs 次没有收到pong的连接会被关闭
+func (s *Server) heartbeat() {
+	if s.pingInterval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(s.pingInterval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-s.done:
+				return
+			}
+			s.conns.Range(func(k, v interface{}) bool {
+				c := v.(*Conn)
+				missed := atomic.AddInt32(&c.missedPongs, 1)
+				if missed > s.maxMissedPongs {
+					//只在第一次超过限制的时候关闭，避免重复加入关闭队列
+					if missed == s.maxMissedPongs+1 {
+						Log.Info("fd 为 %d 的连接连续 %d 次没有回应pong，即将被断开", c.fd, s.maxMissedPongs)
+						c.setCloseStatus(CloseAbnormalClosure, nil)
+						s.closeLater(c)
+					}
+					return true
+				}
+				if err := c.queueControl(PingMessage, nil); err != nil {
+					Log.Error("send ping to fd %d err: %+v", c.fd, err.Error())
+				}
+				return true
+			})
+		}
+	}()
+}
+
 // @Author WangKan
-// @Description //关闭某一个fd, 从conns中删除 conn,从epoll实例中删除fd,并从系统中删除fd
+// @Description //关闭某一个fd, 从conns中删除 conn,从epoll实例中删除fd,并从系统中删除fd，同一个conn只会执行一次
 // @Date 2021/2/2 21:46
 // @Param [c] //Conn
 func (s *Server) closeFd(c *Conn) {
-	//从当前的epoll中删除fd
-	s.ep.eDel(c.fd)
-	//从系统中关闭当前fd
-	_ = syscall.Close(c.fd)
-	//从 s.conns中删除当前fd
-	Log.Info("正在删除fd=%d的连接", c.fd)
-	_ = s.checkTimeOutTree.RemoveNodeValue(c.updateTime, c.fd)
-	s.conns.Delete(c.fd)
-	s.handle.OnClose(c, c.closeCode, c.closeReason)
+	c.closeOnce.Do(func() {
+		//先让还在等待写入的协程立即返回
+		_ = syscall.Shutdown(c.fd, syscall.SHUT_RDWR)
+		//fd关闭之后可能马上被新的连接复用，必须在关闭之前从超时检测树和 s.conns 中删除，否则会删掉新连接的记录
+		Log.Info("正在删除fd=%d的连接", c.fd)
+		s.timeOutMu.Lock()
+		_ = s.checkTimeOutTree.RemoveNodeValue(c.updateTime, c.fd)
+		s.timeOutMu.Unlock()
+		s.conns.Delete(c.fd)
+		//标记连接已关闭之后，读写fd的协程不会再访问这个fd
+		c.fdMu.Lock()
+		c.closed = true
+		c.outBuf = nil
+		if c.outTimer != nil {
+			c.outTimer.Stop()
+			c.outTimer = nil
+		}
+		c.outCond.Broadcast()
+		c.msgMu.Lock()
+		c.outMsgs = nil //消息队列中还没有发送的内容直接丢弃
+		c.released = true
+		c.streamAhead = 0
+		c.msgCond.Broadcast()
+		c.msgMu.Unlock()
+		//从当前的epoll中删除fd，失败时也要关闭fd
+		if err := s.ep.eDel(c.fd); err != nil {
+			Log.Error("%+v", err.Error())
+		}
+		//从系统中关闭当前fd
+		_ = syscall.Close(c.fd)
+		c.fdMu.Unlock()
+		close(c.closeDone)
+		if c.flate != nil {
+			c.flate.release()
+		}
+		code, reason := c.closeStatus()
+		c.handle.OnClose(c, code, reason)
+	})
 }
 
 // @Author WangKan
-// @Description //系统发送Ctrl+c信号的时候，调用此方法关闭所有的连接
+// @Description //系统发送Ctrl+c信号的时候，调用此方法关闭所有的连接。
+// 先停止后台的协程并等待 Run 返回，再关闭连接和epoll，多次调用时只有第一次生效
 // @Date 2021/2/2 21:40
 func (s *Server) Close() {
+	s.stateMu.Lock()
+	if s.closed {
+		s.stateMu.Unlock()
+		return
+	}
+	s.closed = true
+	running := s.running
+	s.stateMu.Unlock()
+	close(s.done)
+	if running {
+		if err := s.ep.wake(); err != nil {
+			Log.Error("Server Close wake err:%+v", err.Error())
+		} else {
+			<-s.runDone //epoll_wait 返回之后才能关闭epoll的fd，否则fd可能被复用
+		}
+	}
 	s.CloseFds()
+	s.closeHandshakes()
+	if err := syscall.Close(s.ep.socket); err != nil {
+		Log.Error("Server Close socket err:%+v", err.Error())
+	}
 	if err := syscall.Close(s.ep.epId); err != nil {
 		Log.Error("Server Close epId err:%+v", err.Error())
 	}
-
+	if err := syscall.Close(s.ep.wakeFd); err != nil {
+		Log.Error("Server Close wakeFd err:%+v", err.Error())
+	}
 }
 
 // @Author WangKan
-// @Description //获取所有的conn 并调用关闭方法
+// @Description //获取所有的conn，通知客户端服务端即将关闭，并调用关闭方法
 // @Date 2021/2/2 21:34
 func (s *Server) CloseFds() {
 	s.conns.Range(func(k, v interface{}) bool {
-		s.closeFd(v.(*Conn))
+		c := v.(*Conn)
+		c.setCloseStatus(CloseGoingAway, nil)
+		_ = c.writeControl(CloseMessage, closePayload(CloseGoingAway, nil))
+		s.closeFd(c)
 		return true
 	})
 }
@@ -299,43 +654,87 @@ func (s *Server) Push() {
 func (s *Server) push() {
 	for {
 		select {
-		case message := <-s.writeMessageChan:
-			msg := s.bytePool.Get().([]byte)
-			msg, err := s.makePushMessage(msg, message)
-			if err != nil {
-				Log.Fatal(err.Error())
-				return
+		case c := <-s.pushChan:
+			s.pushConn(c)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// @Description //按顺序发送一个连接消息队列中的所有消息，队列为空之后如果连接需要释放，等发送队列写完再释放。
+// 同一个连接同一时间只会在一个push协程中，保留了压缩上下文时压缩的顺序和发送的顺序一致
+// @Param c 消息队列中有内容的连接
+func (s *Server) pushConn(c *Conn) {
+	for {
+		message, release := c.nextMessage()
+		if message == nil {
+			if release && c.closeAfterFlush() {
+				go s.closeFd(c) //OnClose 可能阻塞，不能占用push协程
 			}
-			_, _ = syscall.Write(message.Conn.GetFd(), msg)
-			msg = make([]byte, 0, s.writeBufferSize)
-			s.bytePool.Put(msg)
+			return
 		}
+		if message.MessageType != TextMessage && message.MessageType != BinaryMessage { //控制帧
+			if err := c.writeControl(message.MessageType, message.Content); err != nil {
+				Log.Error("push control frame to fd %d err: %+v", c.fd, err.Error())
+			}
+			continue
+		}
+		s.pushMessage(c, message)
+		c.dataSent()
+	}
+}
+
+// pushMessage 编码并发送一条数据消息，需要压缩时先压缩
+func (s *Server) pushMessage(c *Conn, message *Message) {
+	msg := s.bytePool.Get().([]byte)
+	msg, err := s.makePushMessage(msg, message)
+	if err != nil {
+		Log.Error(err.Error())
+		return
 	}
+	//send 不会阻塞，客户端不读取时内容留在这个连接自己的发送队列中，不影响其它连接
+	if err := c.send(msg); err != nil {
+		Log.Error("push message to fd %d err: %+v", c.fd, err.Error())
+	}
+	msg = make([]byte, 0, s.writeBufferSize)
+	s.bytePool.Put(msg)
+}
+
+// shouldCompress 判断一条消息发送时是否需要压缩，只有协商了 permessage-deflate 的连接才能压缩
+func (s *Server) shouldCompress(msge *Message) bool {
+	if !msge.Conn.canCompress || !s.isComporessOn {
+		return false
+	}
+	switch msge.Compress {
+	case CompressForce:
+		return true
+	case CompressSkip:
+		return false
+	}
+	//太短的消息压缩之后可能比原文还长，不压缩直接发送
+	return len(msge.Content) >= s.compressThreshold
 }
 
 func (s *Server) makePushMessage(msg []byte, msge *Message) ([]byte, error) {
-	msg = append(msg, 129)
-	var message []byte
-	if msge.Conn.canCompress == true && s.isComporessOn == true {
+	f := &frame{
+		fin:     true,
+		opcode:  msge.MessageType,
+		payload: msge.Content,
+	}
+	if s.shouldCompress(msge) {
+		var message []byte
 		var err error
-		msg[0] += 64
-		message, err = Compress(msge.Content, s.compressLevel)
+		if fc := msge.Conn.flate; fc != nil && fc.serverTakeover {
+			message, err = fc.compress(msge.Content)
+		} else {
+			message, err = Compress(msge.Content, s.compressLevel)
+		}
 		if err != nil {
 			return nil, fmt.Errorf("Compress %d`s message error ：%+v", msge.Conn.fd, err)
 		}
-		message = append(message, 0)
-		message = message[:len(message)-5]
-	}
-	length := len(message)
-	if length <= 125 {
-		msg = append(msg, byte(length))
-	} else if length > 125 && length < 65535 {
-		msg = append(msg, 126)
-		tmp := int16(length)
-		bytesBuffer := bytes.NewBuffer([]byte{})
-		_ = binary.Write(bytesBuffer, binary.BigEndian, &tmp)
-		msg = append(msg, bytesBuffer.Bytes()...)
-	}
-	msg = append(msg, message...)
-	return msg, nil
+		f.payload = message
+		f.rsv1 = true
+	}
+	return s.encoder.encode(msg, f), nil
 }
@@ -0,0 +1,380 @@
+package gof
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+var errWriterClosed = errors.New("websocket: writer closed")
+
+// messageWriter 流式发送一条消息，缓冲区写满 WriteBufferSize 之后作为一个分片发送出去。
+// 流式发送的消息不做压缩，同一个 messageWriter 不能在多个协程中同时使用。
+// 发送队列积压超过 streamBufferChunks 个分片时 Write 会等待客户端读取
+type messageWriter struct {
+	c           *Conn
+	messageType int    //消息类型，第一帧使用，之后的帧都是延续帧
+	size        int    //每个分片的最大长度
+	buf         []byte //还没有发送出去的内容
+	out         []byte //编码帧用的缓冲区
+	started     bool   //是否已经发送过第一帧
+	closed      bool
+	err         error //发送出错之后，之后的写入都直接返回这个错误
+}
+
+// @Description //获取一个流式发送消息的writer，之前通过 WriteMessage 发送的消息会先发送完，
+// Close之前同一个连接上新的数据消息和 NextWriter 会一直等待，控制帧照常穿插发送，必须调用Close结束这条消息。
+// 只会阻塞调用方，不影响push协程发送其它连接的消息
+// @Param messageType TextMessage 或者 BinaryMessage
+// @return
+func (c *Conn) NextWriter(messageType int) (io.WriteCloser, error) {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return nil, ErrInvalidMessageType
+	}
+	select {
+	case c.streamSem <- struct{}{}:
+	case <-c.closeDone:
+		return nil, ErrConnClosed
+	}
+	if err := c.beginWrite(); err != nil {
+		<-c.streamSem
+		return nil, err
+	}
+	return &messageWriter{
+		c:           c,
+		messageType: messageType,
+		size:        c.s.writeBufferSize,
+		buf:         make([]byte, 0, c.s.writeBufferSize),
+	}, nil
+}
+
+func (w *messageWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errWriterClosed
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		//缓冲区满了并且还有内容要写，才把缓冲区作为一个分片发送出去，保证最后一帧不是空帧
+		if len(w.buf) == w.size {
+			if err := w.flushFrame(false); err != nil {
+				return n - len(p), err
+			}
+		}
+		m := w.size - len(w.buf)
+		if m > len(p) {
+			m = len(p)
+		}
+		w.buf = append(w.buf, p[:m]...)
+		p = p[m:]
+	}
+	return n, nil
+}
+
+// Close 发送最后一帧，结束这条消息
+func (w *messageWriter) Close() error {
+	if w.closed {
+		return errWriterClosed
+	}
+	w.closed = true
+	defer w.c.endWrite()
+	if w.err != nil {
+		return w.err
+	}
+	return w.flushFrame(true)
+}
+
+// flushFrame 将缓冲区中的内容作为一帧发送出去
+func (w *messageWriter) flushFrame(fin bool) error {
+	opcode := ContinuationMessage
+	if !w.started {
+		opcode = w.messageType
+		w.started = true
+	}
+	w.out = w.c.s.encoder.encode(w.out[:0], &frame{
+		fin:     fin,
+		opcode:  opcode,
+		payload: w.buf,
+	})
+	w.buf = w.buf[:0]
+	if err := w.c.send(w.out); err != nil {
+		w.err = err
+		return err
+	}
+	//客户端读取得慢时等发送队列写出去一部分再继续，不让一条很大的消息全部积压在内存中
+	if err := w.c.waitQueue(w.size * streamBufferChunks); err != nil {
+		w.err = err
+		return err
+	}
+	return nil
+}
+
+// beginWrite 开始流式发送，等待消息队列中排在前面的数据消息发送完
+func (c *Conn) beginWrite() error {
+	c.msgMu.Lock()
+	defer c.msgMu.Unlock()
+	if c.released {
+		return ErrConnClosed
+	}
+	if c.closeQueued {
+		return ErrCloseSent
+	}
+	c.streaming = true
+	c.streamAhead = 0
+	for _, m := range c.outMsgs {
+		if m.MessageType == TextMessage || m.MessageType == BinaryMessage {
+			c.streamAhead++
+		}
+	}
+	if c.pushingData {
+		c.streamAhead++
+	}
+	for c.streamAhead > 0 {
+		c.msgCond.Wait()
+	}
+	if c.released {
+		c.streaming = false
+		return ErrConnClosed
+	}
+	return nil
+}
+
+// endWrite 结束流式发送，把等待的数据消息交给push协程
+func (c *Conn) endWrite() {
+	c.msgMu.Lock()
+	c.streaming = false
+	if len(c.outMsgs) > 0 {
+		c.unlockPush()
+	} else {
+		c.msgMu.Unlock()
+	}
+	<-c.streamSem
+}
+
+// 流式读取时，业务方还没有读取的内容超过 streamBufferChunks 个读缓冲区时暂停读取fd
+const streamBufferChunks = 16
+
+// messageReader 流式读取一条消息，帧的负载随着fd上的数据到达写入，业务方在自己的协程中读取。
+// 业务方读取得慢的时候暂停读取fd，读走一半之后再恢复
+type messageReader struct {
+	c         *Conn
+	mu        sync.Mutex
+	chunks    [][]byte      //还没有被读取的负载
+	size      int           //还没有被读取的字节数
+	limit     int           //size 超过 limit 时暂停读取fd
+	eof       bool          //消息的最后一帧已经写入
+	abandoned bool          //OnMessageReader 已经返回，之后的内容直接丢弃
+	notify    chan struct{} //有新内容写入时通知 Read
+}
+
+func newMessageReader(c *Conn) *messageReader {
+	return &messageReader{
+		c:      c,
+		limit:  c.s.readBufferSize * streamBufferChunks,
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// @Description //流式读取时收到数据帧的帧头，消息的第一帧会创建 messageReader 并在新的协程中回调 OnMessageReader。
+// 同一个连接的 OnMessageReader 按消息的顺序依次回调，上一条消息的 OnMessageReader 还没有返回时暂停读取fd
+// @Param h 数据帧的帧头
+func (c *Conn) beginStream(h frameHeader) {
+	if h.opcode == ContinuationMessage {
+		if c.stream == nil { //没有未完成的分片消息，却收到了延续帧
+			Log.Error("fd 为 %d 的连接收到了无法对应的延续帧", c.fd)
+			c.fail(CloseProtocolError, "unexpected continuation frame")
+			return
+		}
+	} else {
+		if c.stream != nil { //上一条分片消息还没有结束，不能开始新的消息
+			Log.Error("fd 为 %d 的连接在分片消息未结束时收到了新的数据帧", c.fd)
+			c.fail(CloseProtocolError, "expected continuation frame")
+			return
+		}
+		handler := c.handle.(MessageReaderInterface)
+		mr := newMessageReader(c)
+		var r io.Reader = mr
+		var dr io.ReadCloser
+		if h.rsv1 && c.canCompress && c.s.isComporessOn {
+			dr = deCompressReader(c, mr)
+			r = dr
+		}
+		if h.opcode == TextMessage {
+			r = &utf8Reader{c: c, r: r}
+		}
+		prev, done := c.streamDone, make(chan struct{})
+		go func(messageType int) {
+			defer c.resumeRead() //等待这条消息处理完而暂停的读取
+			defer close(done)
+			defer mr.abandon()
+			if dr != nil {
+				defer dr.Close() //业务方处理完之后把解压器放回池中
+			}
+			if prev != nil {
+				<-prev
+			}
+			handler.OnMessageReader(c, messageType, r)
+		}(h.opcode)
+		c.stream = mr
+		c.streamSize = 0
+		c.streamDone = done
+		if prev != nil {
+			c.waitStream(prev)
+		}
+	}
+	c.refreshUpdateTime()
+	c.decoder.begin(h)
+}
+
+// @Description //读取当前数据帧的负载并交给 messageReader，业务方处理不过来时暂停读取fd
+// @Param buf 还没有解析的内容
+// @return 消耗的字节数，内容不足时返回false
+func (c *Conn) readStream(buf []byte) (int, bool) {
+	payload, n, done := c.decoder.readPayload(buf)
+	if n == 0 && !done {
+		return 0, false
+	}
+	mr := c.stream
+	c.streamSize += int64(n)
+	last := done && c.decoder.header.fin
+	if last {
+		c.stream = nil
+		c.streamSize = 0
+	}
+	if mr.push(payload, last) {
+		atomic.StoreInt32(&c.readPaused, 1)
+		//设置暂停之前业务方可能已经读走了内容，这时不会再有人恢复读取，需要再检查一次
+		if !mr.full() {
+			atomic.CompareAndSwapInt32(&c.readPaused, 1, 0)
+		}
+	}
+	c.refreshUpdateTime()
+	return n, true
+}
+
+// waitStream 上一条消息的 OnMessageReader 还没有返回时暂停读取fd，返回之后恢复读取，
+// 避免业务方处理得慢时后面的消息一直在内存中堆积
+func (c *Conn) waitStream(prev chan struct{}) {
+	select {
+	case <-prev:
+		return
+	default:
+	}
+	atomic.StoreInt32(&c.readPaused, 1)
+	//设置暂停之前上一条消息可能已经处理完，这时不会再有人恢复读取，需要再检查一次
+	select {
+	case <-prev:
+		atomic.CompareAndSwapInt32(&c.readPaused, 1, 0)
+	default:
+	}
+}
+
+// resumeRead 读取已暂停时，重新开始读取fd
+func (c *Conn) resumeRead() {
+	if atomic.CompareAndSwapInt32(&c.readPaused, 1, 0) {
+		c.s.readConn(c)
+	}
+}
+
+// push 写入一段负载，last 表示消息已经结束，返回是否需要暂停读取fd
+func (r *messageReader) push(b []byte, last bool) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.abandoned {
+		return false
+	}
+	if len(b) > 0 {
+		r.chunks = append(r.chunks, b)
+		r.size += len(b)
+	}
+	if last {
+		r.eof = true
+	}
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+	return r.size >= r.limit
+}
+
+// full 还没有被读取的内容是否已经超过上限
+func (r *messageReader) full() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !r.abandoned && r.size >= r.limit
+}
+
+func (r *messageReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for {
+		r.mu.Lock()
+		if len(r.chunks) > 0 {
+			n := copy(p, r.chunks[0])
+			r.chunks[0] = r.chunks[0][n:]
+			if len(r.chunks[0]) == 0 {
+				r.chunks[0] = nil
+				r.chunks = r.chunks[1:]
+			}
+			r.size -= n
+			resume := r.size < r.limit/2
+			r.mu.Unlock()
+			if resume {
+				r.c.resumeRead()
+			}
+			return n, nil
+		}
+		eof := r.eof
+		r.mu.Unlock()
+		if eof {
+			return 0, io.EOF
+		}
+		select {
+		case <-r.notify:
+		case <-r.c.closeDone:
+			//连接已经关闭，剩下的内容读完之后返回 io.ErrUnexpectedEOF
+			r.mu.Lock()
+			empty := len(r.chunks) == 0 && !r.eof
+			r.mu.Unlock()
+			if empty {
+				return 0, io.ErrUnexpectedEOF
+			}
+		}
+	}
+}
+
+// abandon OnMessageReader 返回之后调用，丢弃还没有读取的内容，并恢复读取fd
+func (r *messageReader) abandon() {
+	r.mu.Lock()
+	r.abandoned = true
+	r.chunks = nil
+	r.size = 0
+	r.mu.Unlock()
+	r.c.resumeRead()
+}
+
+// utf8Reader 流式读取文本消息时校验UTF-8，内容不合法时以1007关闭连接，并向业务方返回错误
+type utf8Reader struct {
+	c *Conn
+	r io.Reader
+	v utf8Validator
+}
+
+func (u *utf8Reader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	valid := u.v.write(p[:n])
+	if valid && err == io.EOF && !u.v.done() {
+		valid = false
+	}
+	if !valid {
+		Log.Error("fd 为 %d 的连接发送的文本消息不是合法的UTF-8", u.c.fd)
+		u.c.s.reportError(u.c, errInvalidUTF8)
+		_ = u.c.Close(errInvalidUTF8.Code, errInvalidUTF8.Text)
+		return n, errInvalidUTF8
+	}
+	return n, err
+}
@@ -70,15 +70,21 @@ func main() {
 	//fmt.Println("===========================================================================")
 	//return
 
-	serve := gof.InitServer("0.0.0.0", 8801, Ws{}, &gof.Conf{
+	serve, err := gof.InitServer("0.0.0.0", 8801, Ws{}, &gof.Conf{
 		ReadBufferSize:    1024,
 		WriteBufferSize:   1024,
 		ConnectionTimeOut: 1000,
 		IsCompressOn:      true,
 		CompressLevel:     9,
 	})
+	if err != nil {
+		fmt.Println("init server err:", err)
+		os.Exit(1)
+	}
 	go func() {
-		serve.Run()
+		if err := serve.Run(); err != nil && err != gof.ErrServerClosed {
+			fmt.Println("server stopped:", err)
+		}
 	}()
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
@@ -3,9 +3,13 @@ package gof
 import (
 	"crypto/sha1"
 	"encoding/base64"
-	"fmt"
-	"strings"
+	"errors"
+	"golang.org/x/sys/unix"
+	"io"
+	"net"
+	"strconv"
 	"syscall"
+	"time"
 )
 
 
@@ -25,54 +29,99 @@ func computeAcceptKey(challengeKey string) string {
 }
 
 
-// @Author WangKan
-// @Description //获取客户端发送的Header头
-// @Date 2021/2/24 15:13
-// @Param
-// @return
-func GetHeaderContent(fd int)  (string,int) {
-	for{
-		var buf [1024]byte
-		nbytes, _ := syscall.Read(fd, buf[:])
-		if nbytes > 0 {
-			return string(buf[:]),nbytes
-		}
+var (
+	errWriteTimeout = errors.New("websocket: write timeout")
+	errReadTimeout  = errors.New("websocket: read timeout")
+	errQueueFull    = errors.New("websocket: write queue full")
+)
+
+// sockaddrToAddr 把 accept 返回的地址转换为 net.Addr，双栈监听时IPv4客户端的地址是 ::ffff:a.b.c.d，String 输出为IPv4的格式
+func sockaddrToAddr(sa syscall.Sockaddr) net.Addr {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return &net.TCPAddr{IP: append(net.IP(nil), sa.Addr[:]...), Port: sa.Port}
+	case *syscall.SockaddrInet6:
+		return &net.TCPAddr{IP: append(net.IP(nil), sa.Addr[:]...), Port: sa.Port, Zone: zoneName(sa.ZoneId)}
 	}
+	return nil
 }
 
+// zoneName 把IPv6地址的zone id转换为网卡名，找不到网卡时使用数字
+func zoneName(id uint32) string {
+	if id == 0 {
+		return ""
+	}
+	if ifi, err := net.InterfaceByIndex(int(id)); err == nil {
+		return ifi.Name
+	}
+	return strconv.FormatUint(uint64(id), 10)
+}
 
-// @Author WangKan
-// @Description //将Header头转换为map
-// @Date 2021/2/24 15:13
-// @Param
-// @return
-func FormatHeader(buf string,length int)(map[string]string){
-	var header =make(map[string]string)
-	str:=""
-	index:=0
-	for i:=0;i<length;i++{
-		if buf[i]==13{
-			if index == 0 {
-				arr:=strings.Split(str," ")
-				fmt.Println(arr)
-				header["Method"]=arr[0]
-				str=""
-				index++
-				continue
-			}
-			if str != ""{
-				arr:=strings.Split(str,": ")
-				header[arr[0]]=arr[1]
-				str=""
-			}
-		}else if buf[i]==10{
+// writeFd 循环写入直到全部写完，fd是非阻塞的，内核写缓冲区满的时候等fd可写之后继续写。
+// 会阻塞调用方，只在握手和普通HTTP请求自己的协程中使用
+func writeFd(fd int, b []byte, timeout time.Duration) error {
+	for {
+		n, err := writeNonblock(fd, b)
+		if err != nil {
+			return err
+		}
+		b = b[n:]
+		if len(b) == 0 {
+			return nil
+		}
+		if err := waitWritable(fd, timeout); err != nil {
+			return err
+		}
+	}
+}
+
+// writeNonblock 写到内核写缓冲区满为止，返回写入的长度，缓冲区满不算出错
+func writeNonblock(fd int, b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		n, err := syscall.Write(fd, b[written:])
+		if n > 0 {
+			written += n
 			continue
-		}else{
-			str += string(buf[i])
+		}
+		switch err {
+		case syscall.EINTR:
+		case syscall.EAGAIN:
+			return written, nil
+		default:
+			if err == nil {
+				err = io.ErrShortWrite
+			}
+			return written, err
 		}
 	}
-	return header
+	return written, nil
 }
 
+// waitWritable 等待fd可写，超时返回 errWriteTimeout
+func waitWritable(fd int, timeout time.Duration) error {
+	return pollFd(fd, unix.POLLOUT, timeout, errWriteTimeout)
+}
 
+// waitReadable 等待fd可读，超时返回 errReadTimeout
+func waitReadable(fd int, timeout time.Duration) error {
+	return pollFd(fd, unix.POLLIN, timeout, errReadTimeout)
+}
 
+// pollFd 等待fd上的事件，超时返回 timeoutErr
+func pollFd(fd int, events int16, timeout time.Duration, timeoutErr error) error {
+	fds := []unix.PollFd{{Fd: int32(fd), Events: events}}
+	for {
+		n, err := unix.Poll(fds, int(timeout/time.Millisecond))
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return timeoutErr
+		}
+		return nil
+	}
+}
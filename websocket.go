@@ -1,20 +1,66 @@
 package gof
 
 import (
+	"encoding/base64"
 	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // HandshakeError describes an error with the handshake from the peer.
 type HandshakeError struct {
+	status  int         //回复给客户端的HTTP状态码
 	message string
+	header  http.Header //拒绝握手时额外回复的响应头
 }
 
 func (e HandshakeError) Error() string { return e.message }
 
+// Status 返回拒绝握手时回复给客户端的HTTP状态码
+func (e HandshakeError) Status() int { return e.status }
+
+// RejectHandshake 在 OnHandshake 中拒绝握手，status 为回复的HTTP状态码，reason 为回复的内容
+func RejectHandshake(status int, reason string) error {
+	return HandshakeError{status: status, message: reason}
+}
+
+// 这些响应头由 Upgrader 自己回复，OnHandshake 返回的同名响应头会被忽略
+var reservedResponseHeaders = map[string]bool{
+	"Upgrade":                  true,
+	"Connection":               true,
+	"Sec-Websocket-Accept":     true,
+	"Sec-Websocket-Protocol":   true,
+	"Sec-Websocket-Extensions": true,
+	"Content-Length":           true,
+}
+
+// appendHeader 把响应头追加到回复中，跳过 Upgrader 自己回复的响应头和包含换行的值
+func appendHeader(b []byte, header http.Header) []byte {
+	for k, values := range header {
+		k = textproto.CanonicalMIMEHeaderKey(k)
+		if reservedResponseHeaders[k] || strings.ContainsAny(k, "\r\n: ") {
+			continue
+		}
+		for _, v := range values {
+			if strings.ContainsAny(v, "\r\n") {
+				continue
+			}
+			b = append(b, k...)
+			b = append(b, ": "...)
+			b = append(b, v...)
+			b = append(b, "\r\n"...)
+		}
+	}
+	return b
+}
+
 type Upgrader struct {
-	// Error specifies the function for generating HTTP error responses. If Error
-	// is nil, then http.Error is used to generate the HTTP response.
+	// Error is called with the HTTP status and the reason before the error
+	// response of a rejected handshake is written, for example to log or count
+	// rejections. The response body is always the message of the reason.
 	Error func(status int, reason error)
 
 	// CheckOrigin returns true if the request Origin header is acceptable. If
@@ -36,52 +82,130 @@ type Upgrader struct {
 
 	// EnableCompression specify if the server should attempt to negotiate per
 	// message compression (RFC 7692). Setting this value to true does not
-	// guarantee that compression will be supported. Currently only "no context
-	// takeover" modes are supported.
+	// guarantee that compression will be supported.
 	EnableCompression bool
+
+	// DisableContextTakeover makes both sides reset the compression context
+	// for every message. This lowers the compression ratio but the connection
+	// does not keep a compressor and a 32K window alive between messages.
+	DisableContextTakeover bool
 }
 
 func (u *Upgrader) returnError(status int, reason string) (*Conn, error) {
-	err := HandshakeError{reason}
+	err := HandshakeError{status: status, message: reason}
 	return nil, err
 }
 
-func (u *Upgrader) Upgrade(fd int, header map[string]string, s *Server) (*Conn, error) {
+// @Description //握手失败时给客户端回复HTTP错误，回复之后由调用方关闭fd
+// @Param fd 客户端的fd err Upgrade 返回的错误
+// @return
+func (u *Upgrader) writeError(fd int, err error, timeout time.Duration) error {
+	status := http.StatusBadRequest
+	var header http.Header
+	if he, ok := err.(HandshakeError); ok {
+		status = he.status
+		header = he.header
+	}
+	if u.Error != nil {
+		u.Error(status, err)
+	}
+	body := err.Error()
+	var b []byte
+	b = append(b, "HTTP/1.1 "...)
+	b = strconv.AppendInt(b, int64(status), 10)
+	b = append(b, ' ')
+	b = append(b, http.StatusText(status)...)
+	b = append(b, "\r\nContent-Type: text/plain; charset=utf-8\r\nConnection: close\r\n"...)
+	switch status {
+	case http.StatusMethodNotAllowed:
+		b = append(b, "Allow: GET\r\n"...)
+	case http.StatusUpgradeRequired: //RFC 6455 4.4，告诉客户端服务端支持的协议和版本
+		b = append(b, "Upgrade: websocket\r\nSec-WebSocket-Version: 13\r\n"...)
+	}
+	b = appendHeader(b, header)
+	b = append(b, "Content-Length: "...)
+	b = strconv.AppendInt(b, int64(len(body)), 10)
+	b = append(b, "\r\n\r\n"...)
+	b = append(b, body...)
+	return writeFd(fd, b, timeout)
+}
+
+// checkSameOrigin 没有 Origin 或者 Origin 的host和 Host 相同时允许握手
+func checkSameOrigin(header http.Header) bool {
+	origin := header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, header.Get("Host"))
+}
+
+func (u *Upgrader) Upgrade(fd int, r *Request, s *Server) (*Conn, error) {
 	const badHandshake = "websocket: the client is not using the websocket protocol: "
-	if Connection, ok := header["Connection"]; ok {
-		cnnt:=false
-		arr := strings.Split(Connection, ",")
-		for _, v := range arr {
-			if strings.Trim(v, " ") == "Upgrade" {
-				cnnt=true
-				break
-			}
-		}
-		if cnnt ==false{
-			return u.returnError(http.StatusBadRequest, badHandshake+"'upgrade' token not found in 'Connection' header")
-		}
+	header := r.header
+	subprotocol := u.selectSubprotocol(header)
+	handle, err := s.selectHandle(r, subprotocol)
+	if err != nil {
+		return nil, err
+	}
+	if !headerContainsToken(header, "Connection", "Upgrade") {
+		return u.returnError(http.StatusUpgradeRequired, badHandshake+"'upgrade' token not found in 'Connection' header")
 	}
 
-	if header["Upgrade"] != "websocket" {
-		return u.returnError(http.StatusBadRequest, badHandshake+"'websocket' token not found in 'Upgrade' header")
+	if !headerContainsToken(header, "Upgrade", "websocket") {
+		return u.returnError(http.StatusUpgradeRequired, badHandshake+"'websocket' token not found in 'Upgrade' header")
 	}
 
-	if header["Method"] != "GET" {
+	if r.method != "GET" {
 		return u.returnError(http.StatusMethodNotAllowed, badHandshake+"request method is not GET")
 	}
-	if header["Sec-WebSocket-Version"] != "13" {
-		return u.returnError(http.StatusBadRequest, "websocket: unsupported version: 13 not found in 'Sec-Websocket-Version' header")
+	if !headerContainsToken(header, "Sec-WebSocket-Version", "13") {
+		return u.returnError(http.StatusUpgradeRequired, "websocket: unsupported version: 13 not found in 'Sec-Websocket-Version' header")
 	}
 
-	//if _, ok := header["Sec-WebSocket-Extensions"]; ok {
+	//默认只允许同源的请求，防止跨站的 WebSocket 劫持
+	checkOrigin := u.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = checkSameOrigin
+	}
+	if !checkOrigin(header) {
+		return u.returnError(http.StatusForbidden, "websocket: request origin not allowed by Upgrader.CheckOrigin")
+	}
+
+	//if _, ok := header["Sec-Websocket-Extensions"]; ok {
 	//	return u.returnError(http.StatusInternalServerError, "websocket: application specific 'Sec-WebSocket-Extensions' headers are unsupported")
 	//}
 
-	challengeKey := header["Sec-WebSocket-Key"]
+	challengeKey := header.Get("Sec-WebSocket-Key")
 	if challengeKey == "" {
 		return u.returnError(http.StatusBadRequest, "websocket: not a websocket handshake: 'Sec-WebSocket-Key' header is missing or blank")
 	}
+	//RFC 6455 4.2.1，Sec-WebSocket-Key 是16个字节的随机数经过base64编码之后的内容
+	if key, err := base64.StdEncoding.DecodeString(challengeKey); err != nil || len(key) != 16 {
+		return u.returnError(http.StatusBadRequest, "websocket: not a websocket handshake: 'Sec-WebSocket-Key' header must be Base64 encoded value of 16-byte in length")
+	}
 	c := newConn(fd, s)
+	c.request = r
+	c.handle = handle
+	c.subprotocol = subprotocol
+	//业务方在回复101之前校验请求，可以拒绝握手或者添加响应头
+	var responseHeader http.Header
+	if h, ok := c.handle.(HandshakeInterface); ok {
+		var err error
+		responseHeader, err = h.OnHandshake(r)
+		if err != nil {
+			if he, ok := err.(HandshakeError); ok {
+				if he.header == nil {
+					he.header = responseHeader
+				}
+				return nil, he
+			}
+			return u.returnError(http.StatusForbidden, err.Error())
+		}
+	}
 	// Use larger of hijacked buffer and connection write buffer for header.
 	wf := s.bytePool.Get().([]byte)
 	defer func() {
@@ -97,25 +221,32 @@ func (u *Upgrader) Upgrade(fd int, header map[string]string, s *Server) (*Conn,
 
 
 	wf = append(wf, "\r\n"...)
-	if compress, ok := header["Accept-Encoding"]; ok {
-		arr := strings.Split(compress, ",")
-		for _, v := range arr {
-			if strings.Trim(v, " ") == "deflate" {
-				c.canCompress = true
-				wf = append(wf, "Sec-WebSocket-Extensions: permessage-deflate; server_no_context_takeover; client_no_context_takeover"...)
-				//wf = append(wf, header["Sec-WebSocket-Extensions"]...)
-			}
+	if c.subprotocol != "" {
+		wf = append(wf, "Sec-WebSocket-Protocol: "...)
+		wf = append(wf, c.subprotocol...)
+		wf = append(wf, "\r\n"...)
+	}
+	//按照 RFC 7692 协商 permessage-deflate，只回复双方都同意的参数
+	if u.EnableCompression {
+		base := compressionOptions{
+			serverNoContextTakeover: u.DisableContextTakeover,
+			clientNoContextTakeover: u.DisableContextTakeover,
+		}
+		//流式读取时消息在业务方的协程中解压，没法按顺序维护解压的上下文，要求客户端不保留上下文
+		if _, ok := c.handle.(MessageReaderInterface); ok {
+			base.clientNoContextTakeover = true
+		}
+		if opts, ok := negotiateCompression(parseExtensions(headerValues(header, "Sec-WebSocket-Extensions")), base); ok {
+			c.canCompress = true
+			c.compression = opts
+			c.flate = newFlateContext(opts, s.compressLevel)
+			c.decoder.allowRSV1 = true
+			wf = append(wf, "Sec-WebSocket-Extensions: "...)
+			wf = append(wf, opts.String()...)
+			wf = append(wf, "\r\n"...)
 		}
 	}
-
-
-
-
-
-
-
-
-	wf = append(wf, "\r\n"...)
+	wf = appendHeader(wf, responseHeader)
 	wf = append(wf, "\r\n"...)
 	c.handShake <- Message{
 		MessageType: -1,
@@ -125,18 +256,15 @@ func (u *Upgrader) Upgrade(fd int, header map[string]string, s *Server) (*Conn,
 	return c, nil
 }
 
-func (u *Upgrader) selectSubprotocol(r *http.Request, responseHeader http.Header) string {
-	if u.Subprotocols != nil {
-		clientProtocols := Subprotocols(r)
-		for _, serverProtocol := range u.Subprotocols {
-			for _, clientProtocol := range clientProtocols {
-				if clientProtocol == serverProtocol {
-					return clientProtocol
-				}
+// selectSubprotocol 按服务端的优先级选择第一个客户端也支持的子协议，没有时返回空字符串
+func (u *Upgrader) selectSubprotocol(header http.Header) string {
+	clientProtocols := parseSubprotocols(headerValues(header, "Sec-WebSocket-Protocol"))
+	for _, serverProtocol := range u.Subprotocols {
+		for _, clientProtocol := range clientProtocols {
+			if clientProtocol == serverProtocol {
+				return clientProtocol
 			}
 		}
-	} else if responseHeader != nil {
-		return responseHeader.Get("Sec-Websocket-Protocol")
 	}
 	return ""
 }
@@ -144,7 +272,12 @@ func (u *Upgrader) selectSubprotocol(r *http.Request, responseHeader http.Header
 // Subprotocols returns the subprotocols requested by the client in the
 // Sec-Websocket-Protocol header.
 func Subprotocols(r *http.Request) []string {
-	h := strings.TrimSpace(r.Header.Get("Sec-Websocket-Protocol"))
+	return parseSubprotocols(r.Header.Get("Sec-Websocket-Protocol"))
+}
+
+// parseSubprotocols 解析 Sec-WebSocket-Protocol 中以逗号分隔的子协议
+func parseSubprotocols(h string) []string {
+	h = strings.TrimSpace(h)
 	if h == "" {
 		return nil
 	}